@@ -4,24 +4,17 @@ package api
 import (
 	"database/sql"
 	"net/http"
-	"os"
-	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 	"unicode"
 
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"io"
 
-	"github.com/google/uuid"
 	B "github.com/janevala/home_be/build"
-	Conf "github.com/janevala/home_be/config"
-	_ "github.com/lib/pq"
-	"github.com/mmcdole/gofeed"
+	"github.com/lib/pq"
 )
 
 type LoginObject struct {
@@ -33,18 +26,32 @@ type LoginObject struct {
 }
 
 type NewsItem struct {
-	Id              int        `json:"id,omitempty"`
-	Title           string     `json:"title,omitempty"`
-	Description     string     `json:"description,omitempty"`
-	Content         string     `json:"content,omitempty"`
-	Link            string     `json:"link,omitempty"`
-	Published       string     `json:"published,omitempty"`
-	PublishedParsed *time.Time `json:"publishedParsed,omitempty"`
-	Source          string     `json:"source,omitempty"`
-	LinkImage       string     `json:"linkImage,omitempty"`
-	Uuid            string     `json:"uuid,omitempty"`
-	Llm             string     `json:"llm,omitempty"`
-	Language        string     `json:"language,omitempty"`
+	Id              int         `json:"id,omitempty"`
+	Title           string      `json:"title,omitempty"`
+	Description     string      `json:"description,omitempty"`
+	DescriptionHtml string      `json:"descriptionHtml,omitempty"`
+	Content         string      `json:"content,omitempty"`
+	Link            string      `json:"link,omitempty"`
+	Published       string      `json:"published,omitempty"`
+	PublishedParsed *time.Time  `json:"publishedParsed,omitempty"`
+	Source          string      `json:"source,omitempty"`
+	LinkImage       string      `json:"linkImage,omitempty"`
+	Uuid            string      `json:"uuid,omitempty"`
+	Llm             string      `json:"llm,omitempty"`
+	Language        string      `json:"language,omitempty"`
+	Category        string      `json:"category,omitempty"`
+	CanonicalId     int         `json:"canonicalId,omitempty"`
+	AlsoCoveredBy   []string    `json:"alsoCoveredBy,omitempty"`
+	Authors         []string    `json:"authors,omitempty"`
+	Tags            []string    `json:"tags,omitempty"`
+	Enclosures      []Enclosure `json:"enclosures,omitempty"`
+
+	Guid            string `json:"-"`
+	CanonicalLink   string `json:"-"`
+	Simhash         uint64 `json:"-"`
+	ThumbnailOrigin string `json:"-"`
+	DateOrigin      string `json:"-"`
+	SiteUrl         string `json:"-"`
 }
 
 type NewsItems struct {
@@ -60,7 +67,18 @@ type ArchiveRefreshResponse struct {
 	Oldest string `json:"oldest"`
 }
 
-func SitesHandler(sites Conf.SitesConfig) http.HandlerFunc {
+// publicSites is the /sites response in its original shape, only the title and url of a site are public
+type publicSites struct {
+	Title string
+	Sites []publicSite
+}
+
+type publicSite struct {
+	Title string
+	Url   string
+}
+
+func SitesHandler(store *SiteStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		switch req.Method {
 		case http.MethodGet:
@@ -70,7 +88,13 @@ func SitesHandler(sites Conf.SitesConfig) http.HandlerFunc {
 				return
 			}
 
-			responseJson, _ := json.Marshal(sites)
+			sites := store.Sites()
+			response := publicSites{Title: sites.Title, Sites: make([]publicSite, 0, len(sites.Sites))}
+			for _, site := range sites.Sites {
+				response.Sites = append(response.Sites, publicSite{Title: site.Title, Url: site.Url})
+			}
+
+			responseJson, _ := json.Marshal(response)
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.WriteHeader(http.StatusOK)
 			w.Write(responseJson)
@@ -78,7 +102,7 @@ func SitesHandler(sites Conf.SitesConfig) http.HandlerFunc {
 	}
 }
 
-func ArchiveRefreshHandler(sites Conf.SitesConfig, db *sql.DB) http.HandlerFunc {
+func ArchiveRefreshHandler(scheduler *Scheduler, db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		switch req.Method {
 		case http.MethodGet:
@@ -88,97 +112,48 @@ func ArchiveRefreshHandler(sites Conf.SitesConfig, db *sql.DB) http.HandlerFunc
 				return
 			}
 
-			row, err := db.Query("SELECT created FROM feed_items ORDER BY created DESC LIMIT 1")
-
+			var lastCreated time.Time
+			err := db.QueryRow("SELECT COALESCE(MAX(created), '1970-01-01') FROM feed_items").Scan(&lastCreated)
 			if err != nil {
 				B.LogErr(err)
 				http.Error(w, "Database refresh error", http.StatusInternalServerError)
 				return
 			}
 
-			defer row.Close()
+			status := "Not needed"
+			if time.Since(lastCreated) > scheduler.interval {
+				// Crawling happens in the scheduler, the request only nudges it instead of waiting for the crawl
+				B.LogOut("Last refresh was at: " + lastCreated.String() + ", triggering scheduler")
+				scheduler.Trigger()
+				status = "Scheduled"
+			}
 
-			if row != nil {
-				for row.Next() {
-					var now = time.Now()
-					var lastCreated time.Time
-					err := row.Scan(&lastCreated)
+			var records int
+			err = db.QueryRow("SELECT COUNT(*) FROM feed_items").Scan(&records)
+			if err != nil {
+				B.LogErr(err)
+				http.Error(w, "Database scan error", http.StatusInternalServerError)
+				return
+			}
 
-					if err != nil {
-						B.LogErr(err)
-						http.Error(w, "Database scan error", http.StatusInternalServerError)
-						return
-					}
+			var oldest time.Time
+			err = db.QueryRow("SELECT COALESCE(MIN(published_parsed), '1970-01-01') FROM feed_items").Scan(&oldest)
+			if err != nil {
+				B.LogErr(err)
+				http.Error(w, "Database scan error", http.StatusInternalServerError)
+				return
+			}
 
-					if now.Sub(lastCreated) > 2*time.Hour {
-						B.LogOut("Starting archive refresh...")
-						B.LogOut("Last refresh was at: " + lastCreated.String())
-						B.LogOut("Current time is: " + now.String())
-
-						var wg sync.WaitGroup
-						wg.Add(1)
-
-						go func() {
-							defer wg.Done()
-							defer B.LogOut("Crawling completed")
-
-							crawl(sites, db)
-
-							var records int
-							err := db.QueryRow("SELECT COUNT(*) FROM feed_items").Scan(&records)
-							if err != nil {
-								http.Error(w, "Database scan error", http.StatusInternalServerError)
-								return
-							}
-
-							var oldest time.Time
-							err = db.QueryRow("SELECT published_parsed FROM feed_items ORDER BY published_parsed ASC LIMIT 1").Scan(&oldest)
-							if err != nil {
-								http.Error(w, "Database scan error", http.StatusInternalServerError)
-								return
-							}
-
-							archiveRefreshResponse := ArchiveRefreshResponse{
-								Status: "Refreshed",
-								Count:  records,
-								Oldest: oldest.String(),
-							}
-
-							responseJson, _ := json.Marshal(archiveRefreshResponse)
-							w.Header().Set("Content-Type", "application/json")
-							w.WriteHeader(http.StatusOK)
-							w.Write(responseJson)
-						}()
-
-						wg.Wait()
-					} else {
-						var records int
-						err := db.QueryRow("SELECT COUNT(*) FROM feed_items").Scan(&records)
-						if err != nil {
-							http.Error(w, "Database scan error", http.StatusInternalServerError)
-							return
-						}
-
-						var oldest time.Time
-						err = db.QueryRow("SELECT published_parsed FROM feed_items ORDER BY published_parsed ASC LIMIT 1").Scan(&oldest)
-						if err != nil {
-							http.Error(w, "Database scan error", http.StatusInternalServerError)
-							return
-						}
-
-						archiveRefreshResponse := ArchiveRefreshResponse{
-							Status: "Not needed",
-							Count:  records,
-							Oldest: oldest.String(),
-						}
-
-						responseJson, _ := json.Marshal(archiveRefreshResponse)
-						w.Header().Set("Content-Type", "application/json")
-						w.WriteHeader(http.StatusOK)
-						w.Write(responseJson)
-					}
-				}
+			archiveRefreshResponse := ArchiveRefreshResponse{
+				Status: status,
+				Count:  records,
+				Oldest: oldest.String(),
 			}
+
+			responseJson, _ := json.Marshal(archiveRefreshResponse)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
 		}
 	}
 }
@@ -218,6 +193,13 @@ func ArticlesHandler(db *sql.DB) http.HandlerFunc {
 				}
 			}
 
+			// Near duplicates from other sources are folded into the item they duplicate
+			collapse := query.Get("collapse") == "dups"
+
+			author := strings.TrimSpace(query.Get("author"))
+			tag := tagSlug(query.Get("tag"))
+			category := strings.TrimSpace(query.Get("category"))
+
 			// Get total count of items
 			// var totalItems int
 			// err := db.QueryRow("SELECT COUNT(*) FROM feed_items").Scan(&totalItems)
@@ -229,11 +211,18 @@ func ArticlesHandler(db *sql.DB) http.HandlerFunc {
 
 			if language == "en" {
 				rows, err := db.Query(
-					`SELECT id, title, description, link, published, published_parsed, source, thumbnail, uuid
+					`SELECT id, title, description, COALESCE(description_html, ''), link, published, published_parsed, source, thumbnail, uuid,
+					category, COALESCE(canonical_id, 0), ARRAY(SELECT d.source FROM feed_items d WHERE d.canonical_id = feed_items.id ORDER BY d.id)
 					FROM feed_items
+					WHERE ($3 = false OR canonical_id IS NULL)
+					AND ($4 = '' OR EXISTS (SELECT 1 FROM feed_item_authors fa JOIN authors a ON a.id = fa.author_id
+						WHERE fa.item_id = feed_items.id AND lower(a.name) = lower($4)))
+					AND ($5 = '' OR EXISTS (SELECT 1 FROM feed_item_tags fg JOIN tags t ON t.id = fg.tag_id
+						WHERE fg.item_id = feed_items.id AND t.slug = $5))
+					AND ($6 = '' OR lower(category) = lower($6))
 					ORDER BY published_parsed DESC
 					LIMIT $1 OFFSET $2`,
-					limit, offset)
+					limit, offset, collapse, author, tag, category)
 
 				if err != nil {
 					B.LogErr(err)
@@ -244,6 +233,7 @@ func ArticlesHandler(db *sql.DB) http.HandlerFunc {
 				var id int
 				var title string
 				var description string
+				var descriptionHtml string
 				var link string
 				var published string
 				var published_parsed *time.Time
@@ -251,10 +241,13 @@ func ArticlesHandler(db *sql.DB) http.HandlerFunc {
 				var thumbnail string
 				var uuid string
 				var llm string = "original"
+				var itemCategory string
+				var canonicalId int
+				var alsoCoveredBy []string
 
 				items := []NewsItem{}
 				for rows.Next() {
-					err := rows.Scan(&id, &title, &description, &link, &published, &published_parsed, &source, &thumbnail, &uuid)
+					err := rows.Scan(&id, &title, &description, &descriptionHtml, &link, &published, &published_parsed, &source, &thumbnail, &uuid, &itemCategory, &canonicalId, pq.Array(&alsoCoveredBy))
 					if err != nil {
 						B.LogErr(err)
 						http.Error(w, "Database scan error", http.StatusInternalServerError)
@@ -265,6 +258,7 @@ func ArticlesHandler(db *sql.DB) http.HandlerFunc {
 						Id:              id,
 						Title:           title,
 						Description:     description,
+						DescriptionHtml: descriptionHtml,
 						Link:            link,
 						Published:       published,
 						PublishedParsed: published_parsed,
@@ -273,11 +267,20 @@ func ArticlesHandler(db *sql.DB) http.HandlerFunc {
 						Uuid:            uuid,
 						Llm:             llm,
 						Language:        language,
+						Category:        itemCategory,
+						CanonicalId:     canonicalId,
+						AlsoCoveredBy:   alsoCoveredBy,
 					})
 				}
 
 				defer rows.Close()
 
+				if err := attachItemMetadata(db, items); err != nil {
+					B.LogErr(err)
+					http.Error(w, "Database query error", http.StatusInternalServerError)
+					return
+				}
+
 				newsItems := NewsItems{
 					Items:      items,
 					TotalItems: 0,
@@ -292,12 +295,19 @@ func ArticlesHandler(db *sql.DB) http.HandlerFunc {
 				w.Write(responseJson)
 			} else {
 				rows, err := db.Query(`SELECT fi.id, fi.link, fi.published, fi.source, fi.thumbnail, fi.uuid,
-					ft.published_parsed, ft.language, ft.title, ft.description, ft.llm
+					ft.published_parsed, ft.language, ft.title, ft.description, ft.llm,
+					fi.category, COALESCE(fi.canonical_id, 0), ARRAY(SELECT d.source FROM feed_items d WHERE d.canonical_id = fi.id ORDER BY d.id)
 					FROM feed_translations ft
 					JOIN feed_items fi ON fi.id = ft.item_id
 					WHERE ft.language = $3
+					AND ($4 = false OR fi.canonical_id IS NULL)
+					AND ($5 = '' OR EXISTS (SELECT 1 FROM feed_item_authors fa JOIN authors a ON a.id = fa.author_id
+						WHERE fa.item_id = fi.id AND lower(a.name) = lower($5)))
+					AND ($6 = '' OR EXISTS (SELECT 1 FROM feed_item_tags fg JOIN tags t ON t.id = fg.tag_id
+						WHERE fg.item_id = fi.id AND t.slug = $6))
+					AND ($7 = '' OR lower(fi.category) = lower($7))
 					ORDER BY ft.published_parsed DESC
-					LIMIT $1 OFFSET $2`, limit, offset, language)
+					LIMIT $1 OFFSET $2`, limit, offset, language, collapse, author, tag, category)
 
 				if err != nil {
 					B.LogErr(err)
@@ -317,10 +327,13 @@ func ArticlesHandler(db *sql.DB) http.HandlerFunc {
 				var ftTitle string
 				var ftDescription string
 				var ftLlm string
+				var fiCategory string
+				var canonicalId int
+				var alsoCoveredBy []string
 
 				items := []NewsItem{}
 				for rows.Next() {
-					err := rows.Scan(&fiId, &fiLink, &fiPublished, &fiSource, &fiThumbnail, &fiUuid, &ftPublishedParsed, &ftLanguage, &ftTitle, &ftDescription, &ftLlm)
+					err := rows.Scan(&fiId, &fiLink, &fiPublished, &fiSource, &fiThumbnail, &fiUuid, &ftPublishedParsed, &ftLanguage, &ftTitle, &ftDescription, &ftLlm, &fiCategory, &canonicalId, pq.Array(&alsoCoveredBy))
 					if err != nil {
 						B.LogErr(err)
 						http.Error(w, "Database scan error", http.StatusInternalServerError)
@@ -339,11 +352,20 @@ func ArticlesHandler(db *sql.DB) http.HandlerFunc {
 						Uuid:            fiUuid,
 						Llm:             ftLlm,
 						Language:        ftLanguage,
+						Category:        fiCategory,
+						CanonicalId:     canonicalId,
+						AlsoCoveredBy:   alsoCoveredBy,
 					})
 				}
 
 				defer rows.Close()
 
+				if err := attachItemMetadata(db, items); err != nil {
+					B.LogErr(err)
+					http.Error(w, "Database query error", http.StatusInternalServerError)
+					return
+				}
+
 				newsItems := NewsItems{
 					Items:      items,
 					TotalItems: 0,
@@ -390,7 +412,7 @@ func ArticleHandler(db *sql.DB) http.HandlerFunc {
 
 			if language == "en" {
 				rows, err := db.Query(
-					`SELECT id, title, description, link, published, published_parsed, source, thumbnail, uuid
+					`SELECT id, title, description, COALESCE(description_html, ''), link, published, published_parsed, source, thumbnail, uuid
 					FROM feed_items
 					WHERE id = $1`,
 					id)
@@ -405,6 +427,7 @@ func ArticleHandler(db *sql.DB) http.HandlerFunc {
 				var source string
 				var title string
 				var description string
+				var descriptionHtml string
 				var link string
 				var published string
 				var published_parsed *time.Time
@@ -414,7 +437,7 @@ func ArticleHandler(db *sql.DB) http.HandlerFunc {
 
 				items := []NewsItem{}
 				for rows.Next() {
-					err := rows.Scan(&id, &title, &description, &link, &published, &published_parsed, &source, &thumbnail, &uuid)
+					err := rows.Scan(&id, &title, &description, &descriptionHtml, &link, &published, &published_parsed, &source, &thumbnail, &uuid)
 					if err != nil {
 						B.LogErr(err)
 						http.Error(w, "Database scan error", http.StatusInternalServerError)
@@ -426,6 +449,7 @@ func ArticleHandler(db *sql.DB) http.HandlerFunc {
 						Source:          source,
 						Title:           title,
 						Description:     description,
+						DescriptionHtml: descriptionHtml,
 						Link:            link,
 						Published:       published,
 						PublishedParsed: published_parsed,
@@ -438,6 +462,12 @@ func ArticleHandler(db *sql.DB) http.HandlerFunc {
 
 				defer rows.Close()
 
+				if err := attachItemMetadata(db, items); err != nil {
+					B.LogErr(err)
+					http.Error(w, "Database query error", http.StatusInternalServerError)
+					return
+				}
+
 				newsItems := NewsItems{
 					Items: items,
 				}
@@ -501,6 +531,12 @@ func ArticleHandler(db *sql.DB) http.HandlerFunc {
 
 				defer rows.Close()
 
+				if err := attachItemMetadata(db, items); err != nil {
+					B.LogErr(err)
+					http.Error(w, "Database query error", http.StatusInternalServerError)
+					return
+				}
+
 				newsItems := NewsItems{
 					Items: items,
 				}
@@ -598,6 +634,12 @@ func SearchHandler(db *sql.DB) http.HandlerFunc {
 
 				defer rows.Close()
 
+				if err := attachItemMetadata(db, items); err != nil {
+					B.LogErr(err)
+					http.Error(w, "Database query error", http.StatusInternalServerError)
+					return
+				}
+
 				newsItems := NewsItems{
 					Items:      items,
 					TotalItems: len(items),
@@ -668,6 +710,12 @@ func SearchHandler(db *sql.DB) http.HandlerFunc {
 
 				defer rows.Close()
 
+				if err := attachItemMetadata(db, items); err != nil {
+					B.LogErr(err)
+					http.Error(w, "Database query error", http.StatusInternalServerError)
+					return
+				}
+
 				newsItems := NewsItems{
 					Items:      items,
 					TotalItems: len(items),
@@ -734,130 +782,22 @@ func FakeAuthHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func crawl(sites Conf.SitesConfig, db *sql.DB) {
-	feedParser := gofeed.NewParser()
-
-	var combinedItems []*NewsItem = []*NewsItem{}
-	for i := 0; i < len(sites.Sites); i++ {
-		feed, err := feedParser.ParseURL(sites.Sites[i].Url)
-		if err != nil {
-			B.LogErr(err)
-		} else {
-			if feed.Image != nil {
-				for j := 0; j < len(feed.Items); j++ {
-					feed.Items[j].Image = feed.Image
-				}
-			} else {
-				for j := 0; j < len(feed.Items); j++ {
-					feed.Items[j].Image = &gofeed.Image{
-						URL:   "https://github.com/janevala/home_be_crawler.git",
-						Title: "N/A",
-					}
-				}
-			}
-
-			var items []*NewsItem = []*NewsItem{}
-			for j := 0; j < len(feed.Items); j++ {
-				NewsItem := &NewsItem{
-					Source:          sites.Sites[i].Title,
-					Title:           strings.TrimSpace(feed.Items[j].Title),
-					Description:     feed.Items[j].Description,
-					Content:         feed.Items[j].Content,
-					Link:            feed.Items[j].Link,
-					Published:       feed.Items[j].Published,
-					PublishedParsed: feed.Items[j].PublishedParsed,
-					LinkImage:       feed.Items[j].Image.URL,
-					Uuid:            uuid.NewString(),
-				}
-
-				items = append(items, NewsItem)
-			}
-
-			combinedItems = append(combinedItems, items...)
-		}
-	}
-
-	if len(combinedItems) > 0 {
-		for i := 0; i < len(combinedItems); i++ {
-			combinedItems[i].Description = ellipticalTruncate(combinedItems[i].Description, 950)
-
-			// Hashing title to create unique ID, that serves as mechanism to prevent duplicates in DB
-			uuidString := base64.StdEncoding.EncodeToString([]byte(ellipticalTruncate(combinedItems[i].Title, 35)))
-			combinedItems[i].Uuid = uuidString
-		}
-
-		sort.Slice(combinedItems, func(i, j int) bool {
-			return combinedItems[i].PublishedParsed.After(*combinedItems[j].PublishedParsed)
-		})
-
-		createTableIfNeeded(db)
-
-		var pkAccumulated int
-		for i := 0; i < len(combinedItems); i++ {
-			var pk = insertItem(db, combinedItems[i])
-			if pk == 0 {
-				continue
-			}
-
-			if pk <= pkAccumulated {
-				B.LogOut("PK minor error")
-			} else {
-				pkAccumulated = pk
-			}
-		}
-	}
-}
-
-func createTableIfNeeded(db *sql.DB) {
-	query := `CREATE TABLE IF NOT EXISTS feed_items (
-		id SERIAL PRIMARY KEY,
-		title VARCHAR(500) NOT NULL,
-		description VARCHAR(1000) NOT NULL,
-		link VARCHAR(500) NOT NULL,
-		published timestamp NOT NULL,
-		published_parsed timestamp NOT NULL,
-		source VARCHAR(300) NOT NULL,
-		thumbnail VARCHAR(500),
-		uuid VARCHAR(300) NOT NULL,
-		language VARCHAR(10),
-		created timestamp DEFAULT NOW(),
-		UNIQUE (uuid)
-	)`
-
-	_, err := db.Exec(query)
-	if err != nil {
-		B.LogErr(err)
-		os.Exit(1)
-	}
-}
-
-func insertItem(db *sql.DB, item *NewsItem) int {
-	query := "INSERT INTO feed_items (title, description, link, published, published_parsed, source, thumbnail, uuid) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING RETURNING id"
-
-	var pk int
-	err := db.QueryRow(query, item.Title, item.Description, item.Link, item.Published, item.PublishedParsed, item.Source, item.LinkImage, item.Uuid).Scan(&pk)
-
-	if err != nil {
-		B.LogOut(err.Error() + " - duplicate uuid: " + item.Uuid)
-	} else {
-		B.LogOut("Inserted item (pk: " + strconv.Itoa(pk) + "): " + ellipticalTruncate(item.Title, 35))
-	}
-
-	return pk
-}
-
-// https://stackoverflow.com/a/73939904 find better way with AI if needed
+// ellipticalTruncate cuts text to at most maxLen runes, at the last space when there is one, and appends "..."
 func ellipticalTruncate(text string, maxLen int) string {
-	lastSpaceIx := maxLen
-	len := 0
+	lastSpaceIx := -1
+	runes := 0
 	for i, r := range text {
+		if runes == maxLen {
+			cut := i
+			if lastSpaceIx > 0 {
+				cut = lastSpaceIx
+			}
+			return strings.TrimRightFunc(text[:cut], unicode.IsSpace) + "..."
+		}
 		if unicode.IsSpace(r) {
 			lastSpaceIx = i
 		}
-		len++
-		if len > maxLen {
-			return text[:lastSpaceIx] + "..."
-		}
+		runes++
 	}
 
 	return text
@@ -0,0 +1,319 @@
+// api/archive.go
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+)
+
+// Where an archived body came from, stored in feed_archive.origin
+const (
+	archiveFromFetch = "fetch"
+	archiveFromPush  = "push"
+)
+
+// ReparseResult counts what a reparse went through
+type ReparseResult struct {
+	Fetches  int `json:"fetches"`
+	Bodies   int `json:"bodies"`
+	Failed   int `json:"failed"`
+	Items    int `json:"items"`
+	Inserted int `json:"inserted"`
+	Updated  int `json:"updated"`
+}
+
+// createArchiveTablesIfNeeded keeps every fetched body once, gzipped and keyed by its SHA-256, and a row per fetch
+func createArchiveTablesIfNeeded(db *sql.DB) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS feed_bodies (
+			hash CHAR(64) PRIMARY KEY,
+			body BYTEA NOT NULL,
+			size INT NOT NULL,
+			created timestamptz NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS feed_archive (
+			id SERIAL PRIMARY KEY,
+			site_url VARCHAR(500) NOT NULL,
+			site_title VARCHAR(200) NOT NULL,
+			site_type VARCHAR(20) NOT NULL DEFAULT '',
+			origin VARCHAR(10) NOT NULL,
+			final_url TEXT NOT NULL DEFAULT '',
+			status INT NOT NULL DEFAULT 0,
+			content_type VARCHAR(200) NOT NULL DEFAULT '',
+			etag VARCHAR(500) NOT NULL DEFAULT '',
+			last_modified VARCHAR(100) NOT NULL DEFAULT '',
+			hash CHAR(64) NOT NULL REFERENCES feed_bodies(hash),
+			fetched_at timestamptz NOT NULL DEFAULT NOW()
+		)`,
+		"CREATE INDEX IF NOT EXISTS feed_archive_fetched_at_idx ON feed_archive (fetched_at)",
+		"CREATE INDEX IF NOT EXISTS feed_archive_site_idx ON feed_archive (site_url, fetched_at)",
+		"CREATE INDEX IF NOT EXISTS feed_archive_hash_idx ON feed_archive (hash)",
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archiveFeedBody stores a raw body with its fetch metadata, failures are logged and never fail the crawl.
+// The body row is locked until the fetch referring to it is in, a concurrent pruneArchive cannot drop it in between.
+func archiveFeedBody(db *sql.DB, site Conf.Site, origin string, finalUrl string, status int, header http.Header, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+
+	tx, err := db.Begin()
+	if err != nil {
+		B.LogErr(err)
+		return
+	}
+
+	defer tx.Rollback()
+
+	var stored bool
+	err = tx.QueryRow("SELECT true FROM feed_bodies WHERE hash = $1 FOR KEY SHARE", hash).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		B.LogErr(err)
+		return
+	}
+
+	if !stored {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			B.LogErr(err)
+			return
+		}
+
+		// A body inserted meanwhile is locked by the update instead
+		_, err := tx.Exec(`INSERT INTO feed_bodies (hash, body, size) VALUES ($1, $2, $3)
+			ON CONFLICT (hash) DO UPDATE SET hash = EXCLUDED.hash`, hash, compressed.Bytes(), len(body))
+		if err != nil {
+			B.LogErr(err)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO feed_archive (site_url, site_title, site_type, origin, final_url, status, content_type, etag, last_modified, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		site.Url, site.Title, strings.ToLower(site.Type), origin, truncateRunes(finalUrl, 2000), status,
+		truncateRunes(header.Get("Content-Type"), 200), truncateRunes(header.Get("ETag"), 500), truncateRunes(header.Get("Last-Modified"), 100), hash)
+	if err != nil {
+		B.LogErr(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		B.LogErr(err)
+	}
+}
+
+// pruneArchive drops fetches older than days and the bodies no fetch refers to any more, 0 keeps everything
+func pruneArchive(db *sql.DB, days int) {
+	if days <= 0 {
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM feed_archive WHERE fetched_at < NOW() - make_interval(days => $1)", days)
+	if err != nil {
+		B.LogErr(err)
+		return
+	}
+
+	if pruned, _ := res.RowsAffected(); pruned == 0 {
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM feed_bodies b WHERE NOT EXISTS (SELECT 1 FROM feed_archive a WHERE a.hash = b.hash)")
+	if err != nil {
+		B.LogErr(err)
+	}
+}
+
+func loadFeedBody(db *sql.DB, hash string) ([]byte, error) {
+	var compressed []byte
+	if err := db.QueryRow("SELECT body FROM feed_bodies WHERE hash = $1", hash).Scan(&compressed); err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
+
+type archivedFetch struct {
+	siteUrl   string
+	siteTitle string
+	siteType  string
+	hash      string
+	fetchedAt time.Time
+}
+
+// Reparse runs the bodies archived between from and to through parsing and normalization again and upserts the items,
+// an empty siteUrl covers every site. Sites use their current settings, a removed site its archived title and type.
+func Reparse(ctx context.Context, db *sql.DB, sites *SiteStore, crawler Conf.CrawlerConfig, from time.Time, to time.Time, siteUrl string) (ReparseResult, error) {
+	var result ReparseResult
+
+	rows, err := db.Query(`SELECT site_url, site_title, site_type, hash, fetched_at FROM feed_archive
+		WHERE fetched_at >= $1 AND fetched_at < $2 AND ($3 = '' OR site_url = $3)
+		ORDER BY fetched_at, id`, from, to, siteUrl)
+	if err != nil {
+		return result, err
+	}
+
+	var fetches []archivedFetch
+	for rows.Next() {
+		var f archivedFetch
+		if err := rows.Scan(&f.siteUrl, &f.siteTitle, &f.siteType, &f.hash, &f.fetchedAt); err != nil {
+			rows.Close()
+			return result, err
+		}
+		fetches = append(fetches, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	current := make(map[string]Conf.Site)
+	for _, managed := range sites.All() {
+		current[managed.Url] = managed.site()
+	}
+
+	var fresh []*NewsItem
+	seen := make(map[string]bool)
+	for _, f := range fetches {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		result.Fetches++
+
+		// Unchanged bodies are parsed once, at their first fetch so first-seen dates stay the earliest
+		if seen[f.siteUrl+"\x00"+f.hash] {
+			continue
+		}
+		seen[f.siteUrl+"\x00"+f.hash] = true
+
+		site, ok := current[f.siteUrl]
+		if !ok {
+			site = Conf.Site{Title: f.siteTitle, Url: f.siteUrl, Type: f.siteType}
+		}
+
+		body, err := loadFeedBody(db, f.hash)
+		if err != nil {
+			return result, fmt.Errorf("body %s: %w", f.hash, err)
+		}
+
+		result.Bodies++
+
+		feed, err := parseFeedBody(site, body)
+		if err != nil {
+			result.Failed++
+			B.LogOut("Reparse of " + f.siteUrl + " fetched at " + f.fetchedAt.Format(time.RFC3339) + " failed: " + err.Error())
+			continue
+		}
+
+		items := applySiteRules(site, feedToItemsAt(site, feed, f.fetchedAt))
+		normalizeItems(items)
+		result.Items += len(items)
+
+		for _, item := range items {
+			inserted, err := upsertItem(db, item)
+			if err != nil {
+				B.LogErr(err)
+				continue
+			}
+
+			if inserted {
+				result.Inserted++
+				fresh = append(fresh, item)
+			} else {
+				result.Updated++
+			}
+		}
+	}
+
+	// A reparse is a one-off command, nothing drains the page queue
+	runPageJobs(ctx, db, pageJobs(fresh, crawler.Extract), maxParallel(crawler))
+
+	B.LogOut("Reparse: " + strconv.Itoa(result.Bodies) + " bodies, " + strconv.Itoa(result.Inserted) + " inserted, " + strconv.Itoa(result.Updated) + " updated")
+	return result, nil
+}
+
+// upsertItem inserts an item or rewrites the derived columns of the stored one. Unlike a revision this is not an edit
+// by the publisher and keeps no history. Dates that only record when the item was first seen are left alone.
+func upsertItem(db *sql.DB, item *NewsItem) (bool, error) {
+	id, _, _, _, err := findKnownItem(db, item)
+	if err == sql.ErrNoRows {
+		pk := insertItem(db, item)
+		if pk == 0 {
+			return false, fmt.Errorf("insert of %s failed", item.Uuid)
+		}
+
+		item.Id = pk
+		insertItemMetadata(db, item)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	feedDate := item.DateOrigin != dateFromFirstSeen && !strings.HasSuffix(item.DateOrigin, dateClamped)
+
+	_, err = db.Exec(`UPDATE feed_items SET title = $2, description = $3, description_html = $4, link = $5, canonical_link = $6,
+		simhash = $7, guid = $8, content = $9, language = $10, category = $17,
+		thumbnail = CASE WHEN $11 <> '' THEN $11 ELSE thumbnail END,
+		thumbnail_origin = CASE WHEN $11 <> '' THEN $12 ELSE thumbnail_origin END,
+		published = CASE WHEN $13 THEN $14::timestamptz ELSE published END,
+		published_parsed = CASE WHEN $13 THEN $15 ELSE published_parsed END,
+		date_origin = CASE WHEN $13 THEN $16 ELSE date_origin END
+		WHERE id = $1`,
+		id, item.Title, item.Description, item.DescriptionHtml, item.Link, item.CanonicalLink,
+		int64(item.Simhash), item.Guid, item.Content, item.Language,
+		item.LinkImage, item.ThumbnailOrigin,
+		feedDate, item.Published, item.PublishedParsed, item.DateOrigin, item.Category)
+	if err != nil {
+		return false, err
+	}
+
+	item.Id = id
+	for _, query := range []string{
+		"DELETE FROM feed_item_authors WHERE item_id = $1",
+		"DELETE FROM feed_item_tags WHERE item_id = $1",
+		"DELETE FROM enclosures WHERE item_id = $1",
+	} {
+		if _, err := db.Exec(query, id); err != nil {
+			return false, err
+		}
+	}
+	insertItemMetadata(db, item)
+
+	return false, nil
+}
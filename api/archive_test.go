@@ -0,0 +1,56 @@
+// api/archive_test.go
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	Conf "github.com/janevala/home_be/config"
+)
+
+func TestArchiveFeedBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		stored    bool
+		archiveOk bool
+	}{
+		{name: "known body", stored: true, archiveOk: true},
+		{name: "new body", archiveOk: true},
+		// The body is not left behind without the fetch that refers to it
+		{name: "archive insert fails"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+
+			mock.ExpectBegin()
+			query := mock.ExpectQuery("SELECT true FROM feed_bodies WHERE hash = \\$1 FOR KEY SHARE")
+			if tt.stored {
+				query.WillReturnRows(sqlmock.NewRows([]string{"stored"}).AddRow(true))
+			} else {
+				query.WillReturnRows(sqlmock.NewRows([]string{"stored"}))
+				mock.ExpectExec("INSERT INTO feed_bodies .* ON CONFLICT \\(hash\\) DO UPDATE SET hash = EXCLUDED.hash").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			archive := mock.ExpectExec("INSERT INTO feed_archive")
+			if tt.archiveOk {
+				archive.WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			} else {
+				archive.WillReturnError(errors.New("connection reset"))
+				mock.ExpectRollback()
+			}
+
+			site := Conf.Site{Title: "Example", Url: "https://example.com/feed.xml"}
+			archiveFeedBody(db, site, archiveFromFetch, site.Url, http.StatusOK, http.Header{}, []byte("<rss/>"))
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
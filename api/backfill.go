@@ -0,0 +1,434 @@
+// api/backfill.go
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	defaultBackfillPages = 10
+	maxBackfillPages     = 500
+	backfillTimeout      = time.Hour
+
+	archiveFromBackfill = "backfill"
+)
+
+// Why a backfill stopped, BackfillResult.Stopped
+const (
+	backfillDepth  = "depth"
+	backfillDate   = "date"
+	backfillEnd    = "end"
+	backfillRepeat = "repeat"
+	backfillEmpty  = "empty"
+)
+
+// BackfillOptions bound a backfill by pages followed and, when set, by the date of the items
+type BackfillOptions struct {
+	Pages int        `json:"pages"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+type BackfillResult struct {
+	Pages    int        `json:"pages"`
+	Items    int        `json:"items"`
+	Inserted int        `json:"inserted"`
+	Revised  int        `json:"revised"`
+	Oldest   *time.Time `json:"oldest,omitempty"`
+	Stopped  string     `json:"stopped"`
+}
+
+// Backfill walks the history of a feed and stores the items of every page. RFC 5005 prev-archive and next links
+// are followed, as is next_url of a JSON Feed. WordPress feeds without them are paged with ?paged=N.
+// Items older than opts.Until are skipped and end the walk.
+func Backfill(ctx context.Context, db *sql.DB, site Conf.Site, crawler Conf.CrawlerConfig, opts BackfillOptions) (BackfillResult, error) {
+	var result BackfillResult
+
+	switch strings.ToLower(site.Type) {
+	case sourceHackerNews, sourceGoogleNews, sourceHtml:
+		return result, fmt.Errorf("%s sites have no feed history to backfill", site.Type)
+	}
+
+	pages := opts.Pages
+	if pages <= 0 {
+		pages = defaultBackfillPages
+	}
+	pages = min(pages, maxBackfillPages)
+
+	timeout := time.Duration(crawler.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+
+	// Every item of a page counts, and historical items are extracted when first read instead of all at once
+	site.MaxItems = 0
+	crawler.Extract = false
+
+	pageUrl := site.Url
+	wordPress := false
+	visited := make(map[string]bool)
+	seen := make(map[string]bool)
+
+	for page := 1; ; page++ {
+		if page > pages {
+			result.Stopped = backfillDepth
+			break
+		}
+
+		visited[pageUrl] = true
+
+		fetched, err := fetchBackfillPage(ctx, db, site, pageUrl, timeout)
+		if err != nil {
+			// WordPress answers past the last page with 404
+			if wordPress && fetched.status == http.StatusNotFound {
+				result.Stopped = backfillEnd
+				break
+			}
+			return result, fmt.Errorf("page %d (%s): %w", page, pageUrl, err)
+		}
+
+		feed, err := parseFeedBody(site, fetched.body)
+		if err != nil {
+			return result, fmt.Errorf("page %d (%s): %w", page, pageUrl, err)
+		}
+
+		result.Pages++
+
+		if len(feed.Items) == 0 {
+			result.Stopped = backfillEmpty
+			break
+		}
+
+		var unseen []*NewsItem
+		for _, item := range feedToItems(site, feed) {
+			key := item.Guid
+			if key == "" {
+				key = item.Link
+			}
+			if !seen[key] {
+				seen[key] = true
+				unseen = append(unseen, item)
+			}
+		}
+
+		var kept []*NewsItem
+		older := 0
+		for _, item := range applySiteRules(site, unseen) {
+			if opts.Until != nil && item.PublishedParsed != nil && item.PublishedParsed.Before(*opts.Until) {
+				older++
+				continue
+			}
+
+			if item.PublishedParsed != nil && (result.Oldest == nil || item.PublishedParsed.Before(*result.Oldest)) {
+				oldest := *item.PublishedParsed
+				result.Oldest = &oldest
+			}
+
+			kept = append(kept, item)
+		}
+
+		// A server that ignores the page parameter keeps answering with the first page
+		if page > 1 && len(unseen) == 0 {
+			result.Stopped = backfillRepeat
+			break
+		}
+
+		if len(kept) > 0 {
+			result.Items += len(kept)
+			inserted, revised := storeItems(ctx, db, crawler, kept)
+			result.Inserted += inserted[site.Url]
+			result.Revised += revised[site.Url]
+		}
+
+		if older > 0 {
+			result.Stopped = backfillDate
+			break
+		}
+
+		next := nextBackfillPage(site, fetched)
+		if next == "" && page == 1 && isWordPress(feed) {
+			wordPress = true
+		}
+		if wordPress {
+			next = wordPressPage(site.Url, page+1)
+		}
+
+		if next == "" {
+			result.Stopped = backfillEnd
+			break
+		}
+		if visited[next] {
+			result.Stopped = backfillRepeat
+			break
+		}
+
+		pageUrl = next
+	}
+
+	B.LogOut("Backfill of " + site.Url + ": " + strconv.Itoa(result.Pages) + " pages, " + strconv.Itoa(result.Inserted) + " inserted, stopped by " + result.Stopped)
+	return result, nil
+}
+
+type backfillPage struct {
+	url    string
+	status int
+	header http.Header
+	body   []byte
+}
+
+// fetchBackfillPage fetches without validators, a 304 for the first page would leave nothing to walk
+func fetchBackfillPage(ctx context.Context, db *sql.DB, site Conf.Site, pageUrl string, timeout time.Duration) (backfillPage, error) {
+	fetched := backfillPage{url: pageUrl}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageUrl, nil)
+	if err != nil {
+		return fetched, err
+	}
+
+	setSiteHeaders(req, site)
+
+	resp, err := crawlClient.Do(req)
+	if err != nil {
+		return fetched, err
+	}
+
+	defer resp.Body.Close()
+
+	fetched.url = resp.Request.URL.String()
+	fetched.status = resp.StatusCode
+	fetched.header = resp.Header
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fetched, gofeed.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	fetched.body, err = readBody(resp.Body)
+	if err != nil {
+		return fetched, err
+	}
+
+	archiveFeedBody(db, site, archiveFromBackfill, fetched.url, resp.StatusCode, resp.Header, fetched.body)
+
+	return fetched, nil
+}
+
+// nextBackfillPage picks the link to older items: prev-archive of an archived feed, next of a paged one
+func nextBackfillPage(site Conf.Site, fetched backfillPage) string {
+	base, err := url.Parse(fetched.url)
+	if err != nil {
+		return ""
+	}
+
+	if strings.ToLower(site.Type) == sourceJsonFeed {
+		var parsed jsonFeed
+		if err := json.Unmarshal(fetched.body, &parsed); err == nil && parsed.NextUrl != "" {
+			return absoluteUrl(base, parsed.NextUrl)
+		}
+		return headerLinks(base, fetched.header)["next"]
+	}
+
+	links := pageLinks(base, fetched.header, fetched.body)
+	if links["prev-archive"] != "" {
+		return links["prev-archive"]
+	}
+
+	return links["next"]
+}
+
+func isWordPress(feed *gofeed.Feed) bool {
+	return strings.Contains(strings.ToLower(feed.Generator), "wordpress")
+}
+
+// wordPressPage sets ?paged=N on the feed url, keeping any other query parameters
+func wordPressPage(feedUrl string, page int) string {
+	u, err := url.Parse(feedUrl)
+	if err != nil {
+		return ""
+	}
+
+	query := u.Query()
+	query.Set("paged", strconv.Itoa(page))
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// BackfillStatus is a running or finished backfill of a site
+type BackfillStatus struct {
+	Title    string          `json:"title"`
+	Url      string          `json:"url"`
+	Options  BackfillOptions `json:"options"`
+	Running  bool            `json:"running"`
+	Started  time.Time       `json:"started"`
+	Finished *time.Time      `json:"finished,omitempty"`
+	Result   BackfillResult  `json:"result"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// Backfills runs backfills in the background, one at a time per site, and keeps the last outcome of each
+type Backfills struct {
+	db      *sql.DB
+	crawler Conf.CrawlerConfig
+
+	mu   sync.Mutex
+	jobs map[string]*BackfillStatus
+}
+
+func NewBackfills(crawler Conf.CrawlerConfig, db *sql.DB) *Backfills {
+	return &Backfills{
+		db:      db,
+		crawler: crawler,
+		jobs:    make(map[string]*BackfillStatus),
+	}
+}
+
+// Start begins a backfill of the site unless one is already running for it
+func (b *Backfills) Start(site Conf.Site, opts BackfillOptions) (BackfillStatus, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if job, ok := b.jobs[site.Url]; ok && job.Running {
+		return *job, false
+	}
+
+	if opts.Pages <= 0 {
+		opts.Pages = b.crawler.BackfillPages
+	}
+	if opts.Pages <= 0 {
+		opts.Pages = defaultBackfillPages
+	}
+
+	job := &BackfillStatus{Title: site.Title, Url: site.Url, Options: opts, Running: true, Started: time.Now()}
+	b.jobs[site.Url] = job
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), backfillTimeout)
+		defer cancel()
+
+		result, err := Backfill(ctx, b.db, site, b.crawler, opts)
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		finished := time.Now()
+		job.Running = false
+		job.Finished = &finished
+		job.Result = result
+		if err != nil {
+			B.LogErr(err)
+			job.Error = err.Error()
+		}
+	}()
+
+	return *job, true
+}
+
+// Status lists the backfills, latest first
+func (b *Backfills) Status() []BackfillStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	statuses := make([]BackfillStatus, 0, len(b.jobs))
+	for _, job := range b.jobs {
+		statuses = append(statuses, *job)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Started.After(statuses[j].Started)
+	})
+
+	return statuses
+}
+
+// parseUntil reads a date as 2006-01-02 or RFC 3339
+func parseUntil(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.UTC); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// BackfillHandler lists backfills and starts one for a managed site: POST /sites/backfill?id=3&pages=20&until=2025-01-01
+func BackfillHandler(backfills *Backfills, store *SiteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isAdmin(req) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var response any
+		status := http.StatusOK
+
+		switch req.Method {
+		case http.MethodGet:
+			response = backfills.Status()
+
+		case http.MethodPost:
+			id, ok := siteId(req)
+			if !ok {
+				http.Error(w, "Missing id", http.StatusBadRequest)
+				return
+			}
+
+			managed, ok := store.find(id)
+			if !ok {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+
+			var opts BackfillOptions
+			if p := req.URL.Query().Get("pages"); p != "" {
+				pages, err := strconv.Atoi(p)
+				if err != nil || pages <= 0 || pages > maxBackfillPages {
+					http.Error(w, "Invalid pages", http.StatusBadRequest)
+					return
+				}
+				opts.Pages = pages
+			}
+
+			if u := req.URL.Query().Get("until"); u != "" {
+				until, err := parseUntil(u)
+				if err != nil {
+					http.Error(w, "Invalid until", http.StatusBadRequest)
+					return
+				}
+				opts.Until = &until
+			}
+
+			job, started := backfills.Start(managed.site(), opts)
+			if !started {
+				http.Error(w, "Backfill already running", http.StatusConflict)
+				return
+			}
+
+			response = job
+			status = http.StatusAccepted
+
+		default:
+			return
+		}
+
+		responseJson, _ := json.Marshal(response)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(status)
+		w.Write(responseJson)
+	}
+}
@@ -0,0 +1,52 @@
+// api/cache.go
+package api
+
+import (
+	"database/sql"
+
+	B "github.com/janevala/home_be/build"
+)
+
+// feedCache holds the validators of the last full response of a feed, used for conditional GET
+type feedCache struct {
+	Etag          string
+	LastModified  string
+	ContentLength int64
+}
+
+func createCacheTableIfNeeded(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS feed_cache (
+		url VARCHAR(500) PRIMARY KEY,
+		etag VARCHAR(500) NOT NULL DEFAULT '',
+		last_modified VARCHAR(100) NOT NULL DEFAULT '',
+		content_length BIGINT NOT NULL DEFAULT 0,
+		updated timestamptz DEFAULT NOW()
+	)`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	return migrateTimestamptz(db, "feed_cache", "updated")
+}
+
+func loadFeedCache(db *sql.DB, url string) feedCache {
+	var cache feedCache
+	err := db.QueryRow("SELECT etag, last_modified, content_length FROM feed_cache WHERE url = $1", url).Scan(&cache.Etag, &cache.LastModified, &cache.ContentLength)
+	if err != nil && err != sql.ErrNoRows {
+		B.LogErr(err)
+	}
+
+	return cache
+}
+
+func saveFeedCache(db *sql.DB, url string, cache feedCache) {
+	query := `INSERT INTO feed_cache (url, etag, last_modified, content_length, updated) VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (url) DO UPDATE SET etag = $2, last_modified = $3, content_length = $4, updated = NOW()`
+
+	_, err := db.Exec(query, url, cache.Etag, cache.LastModified, cache.ContentLength)
+	if err != nil {
+		B.LogErr(err)
+	}
+}
@@ -0,0 +1,158 @@
+// api/cadence.go
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMinInterval = 15 * time.Minute
+	defaultMaxInterval = 12 * time.Hour
+
+	// Posting history a cadence is learned from
+	cadenceWindow   = 30 * 24 * time.Hour
+	cadenceItems    = 50
+	minCadenceItems = 3
+)
+
+// sy:updatePeriod values of the RSS syndication module
+var updatePeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+func migrateCadence(db *sql.DB) error {
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS feed_items_source_published ON feed_items (source, published_parsed)")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// postingCadence is the median gap between the recent items of a source, 0 when there are too few to tell.
+// Items dated when they were first seen follow the crawls rather than the publisher and are left out.
+func postingCadence(db *sql.DB, source string, now time.Time) (time.Duration, error) {
+	rows, err := db.Query(`SELECT published_parsed FROM feed_items
+		WHERE source = $1 AND date_origin <> $2 AND published_parsed > $3
+		ORDER BY published_parsed DESC
+		LIMIT $4`, source, dateFromFirstSeen, now.Add(-cadenceWindow), cadenceItems)
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	var published []time.Time
+	for rows.Next() {
+		var t time.Time
+		if err := rows.Scan(&t); err != nil {
+			return 0, err
+		}
+		published = append(published, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return medianGap(published), nil
+}
+
+// medianGap takes times newest first, a median keeps one quiet weekend or a burst of posts from swinging the result
+func medianGap(published []time.Time) time.Duration {
+	if len(published) < minCadenceItems {
+		return 0
+	}
+
+	gaps := make([]time.Duration, 0, len(published)-1)
+	for i := 1; i < len(published); i++ {
+		gaps = append(gaps, published[i-1].Sub(published[i]))
+	}
+
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+
+	return gaps[len(gaps)/2]
+}
+
+// updateHint reads how often an RSS feed says it changes: ttl in minutes, or sy:updatePeriod divided by
+// sy:updateFrequency. Both only appear at channel level, the items are not read.
+func updateHint(body []byte) time.Duration {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var ttl, period time.Duration
+	frequency := 1
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		name := strings.ToLower(start.Name.Local)
+		if name == "item" || name == "entry" {
+			break
+		}
+
+		if name != "ttl" && name != "updateperiod" && name != "updatefrequency" {
+			continue
+		}
+
+		var value string
+		if err := decoder.DecodeElement(&value, &start); err != nil {
+			break
+		}
+		value = strings.TrimSpace(value)
+
+		switch name {
+		case "ttl":
+			if minutes, err := strconv.Atoi(value); err == nil && minutes > 0 {
+				ttl = time.Duration(minutes) * time.Minute
+			}
+		case "updateperiod":
+			period = updatePeriods[strings.ToLower(value)]
+		case "updatefrequency":
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				frequency = n
+			}
+		}
+	}
+
+	if period > 0 {
+		period /= time.Duration(frequency)
+	}
+
+	return max(ttl, period)
+}
+
+// adaptInterval crawls twice per posting gap, so a new item waits a quarter of the gap on average, and never more
+// often than the feed hint asks. Without a cadence the fallback interval stays. The result is kept within bounds.
+func adaptInterval(cadence time.Duration, hint time.Duration, fallback time.Duration, lower time.Duration, upper time.Duration) time.Duration {
+	every := fallback
+	if cadence > 0 {
+		every = cadence / 2
+	}
+
+	every = max(every, hint)
+
+	return min(max(every, lower), upper)
+}
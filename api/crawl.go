@@ -0,0 +1,383 @@
+// api/crawl.go
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	defaultFetchTimeout = 30 * time.Second
+	defaultMaxParallel  = 4
+
+	// Leaves room for the ellipsis in feed_items.description
+	maxDescriptionLength = 950
+)
+
+// CrawlResult is the outcome of crawling a single site
+type CrawlResult struct {
+	Title       string        `json:"title"`
+	Url         string        `json:"url"`
+	Status      int           `json:"status"`
+	NotModified bool          `json:"notModified"`
+	Disallowed  bool          `json:"disallowed,omitempty"`
+	Bytes       int64         `json:"bytes"`
+	BytesSaved  int64         `json:"bytesSaved"`
+	Items       int           `json:"items"`
+	Inserted    int           `json:"inserted"`
+	Revised     int           `json:"revised"`
+	Duration    time.Duration `json:"-"`
+	DurationMs  int64         `json:"durationMs"`
+	Attempts    int           `json:"attempts"`
+	Hub         string        `json:"hub,omitempty"`
+	Topic       string        `json:"-"`
+	UpdateHint  time.Duration `json:"-"`
+	Error       string        `json:"error,omitempty"`
+	Err         error         `json:"-"`
+}
+
+type fetchResult struct {
+	site        Conf.Site
+	items       []*NewsItem
+	status      int
+	notModified bool
+	bytes       int64
+	bytesSaved  int64
+	validators  *feedCache
+	err         error
+	duration    time.Duration
+	attempts    int
+	hub         string
+	topic       string
+	hint        time.Duration
+}
+
+// crawl fetches the given sites concurrently and stores their items, returning one result per site in the same order
+func crawl(ctx context.Context, sites Conf.SitesConfig, db *sql.DB, crawler Conf.CrawlerConfig) []CrawlResult {
+	fetched := fetchSites(ctx, sites.Sites, db, crawler)
+	results := make([]CrawlResult, len(fetched))
+
+	var combinedItems []*NewsItem = []*NewsItem{}
+	for i, f := range fetched {
+		results[i] = CrawlResult{
+			Title:       f.site.Title,
+			Url:         f.site.Url,
+			Status:      f.status,
+			NotModified: f.notModified,
+			Bytes:       f.bytes,
+			BytesSaved:  f.bytesSaved,
+			Duration:    f.duration,
+			DurationMs:  f.duration.Milliseconds(),
+			Attempts:    f.attempts,
+			Hub:         f.hub,
+			Topic:       f.topic,
+			UpdateHint:  f.hint,
+			Err:         f.err,
+		}
+
+		if f.err != nil {
+			B.LogErr(f.err)
+			results[i].Error = f.err.Error()
+			results[i].Disallowed = errors.Is(f.err, errDisallowed)
+			continue
+		}
+
+		if f.notModified {
+			B.LogOut("Not modified: " + f.site.Url)
+			continue
+		}
+
+		results[i].Items = len(f.items)
+		combinedItems = append(combinedItems, f.items...)
+	}
+
+	if len(combinedItems) > 0 {
+		inserted, revised := storeItems(ctx, db, crawler, combinedItems)
+
+		for i := range results {
+			results[i].Inserted = inserted[results[i].Url]
+			results[i].Revised = revised[results[i].Url]
+		}
+	}
+
+	// Validators are saved only now, a crawl that dies before storing gets the same body again
+	for _, f := range fetched {
+		if f.err == nil && f.validators != nil {
+			saveFeedCache(db, f.site.Url, *f.validators)
+		}
+	}
+
+	pruneArchive(db, crawler.ArchiveDays)
+
+	crawlId := uuid.NewString()
+	for i := range results {
+		insertFetchLog(db, crawlId, results[i])
+	}
+
+	return results
+}
+
+// storeItems normalizes items and inserts the new ones, known items are revised in place. Crawls and WebSub pushes
+// both end here. The counts are per site url.
+func storeItems(ctx context.Context, db *sql.DB, crawler Conf.CrawlerConfig, items []*NewsItem) (inserted map[string]int, revised map[string]int) {
+	normalizeItems(items)
+
+	inserted = make(map[string]int)
+	revised = make(map[string]int)
+	var fresh []*NewsItem
+	var pkAccumulated int
+	for i := 0; i < len(items); i++ {
+		if known, changed := reviseItem(db, items[i]); known {
+			if changed {
+				revised[items[i].SiteUrl]++
+			}
+			continue
+		}
+
+		var pk = insertItem(db, items[i])
+		if pk == 0 {
+			continue
+		}
+
+		items[i].Id = pk
+		insertItemMetadata(db, items[i])
+		fresh = append(fresh, items[i])
+		inserted[items[i].SiteUrl]++
+
+		if pk <= pkAccumulated {
+			B.LogOut("PK minor error")
+		} else {
+			pkAccumulated = pk
+		}
+	}
+
+	// Extraction runs in the background, thumbnails then come from the page it fetches
+	jobs := pageJobs(fresh, crawler.Extract)
+	if crawler.Extract {
+		queuePageJobs(jobs)
+	} else {
+		runPageJobs(ctx, db, jobs, maxParallel(crawler))
+	}
+
+	return inserted, revised
+}
+
+// normalizeItems cleans the text of items, derives their identity and sorts them newest first
+func normalizeItems(items []*NewsItem) {
+	for i := 0; i < len(items); i++ {
+		item := items[i]
+		item.Title = plainText(item.Title)
+		item.DescriptionHtml = sanitizeHtml(item.Description, maxDescriptionLength)
+		item.Description = plainText(item.Description)
+		item.CanonicalLink = canonicalizeLink(item.Link)
+		item.Uuid = itemIdentity(item.Source, item.Guid, item.Link, item.Title, item.Description)
+		item.Simhash = simhash(item.Title + " " + item.Description)
+		item.Description = ellipticalTruncate(item.Description, maxDescriptionLength)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].PublishedParsed.After(*items[j].PublishedParsed)
+	})
+}
+
+// maxParallel is the configured number of sites or pages worked on at once, or the default when there is none
+func maxParallel(crawler Conf.CrawlerConfig) int {
+	if crawler.MaxParallel > 0 {
+		return crawler.MaxParallel
+	}
+
+	return defaultMaxParallel
+}
+
+// fetchSites runs a bounded pool of workers, each site gets its own timeout so one hanging site cannot stall the rest
+func fetchSites(ctx context.Context, sites []Conf.Site, db *sql.DB, crawler Conf.CrawlerConfig) []fetchResult {
+	timeout := time.Duration(crawler.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+
+	retries := crawler.Retries
+	if retries <= 0 {
+		retries = defaultRetries
+	}
+
+	workers := maxParallel(crawler)
+	if workers > len(sites) {
+		workers = len(sites)
+	}
+
+	results := make([]fetchResult, len(sites))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = fetchSite(ctx, sites[i], db, timeout, retries)
+			}
+		}()
+	}
+
+	for i := range sites {
+		jobs <- i
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	return results
+}
+
+// fetchSite runs the source of the site type, a 304 answer leaves items empty and counts the cached size as saved.
+// Transient errors are retried with backoff, every attempt gets the full timeout.
+func fetchSite(ctx context.Context, site Conf.Site, db *sql.DB, timeout time.Duration, retries int) (result fetchResult) {
+	start := time.Now()
+	result.site = site
+
+	if err := ctx.Err(); err != nil {
+		result.err = err
+		return result
+	}
+
+	source, err := sourceFor(site, db)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	defer func() { result.duration = time.Since(start) }()
+
+	var fetched sourceResult
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		fetched, err = source.Fetch(attemptCtx, site)
+		cancel()
+
+		result.attempts++
+		if result.attempts > retries || !isTransient(err) || ctx.Err() != nil {
+			break
+		}
+
+		delay := backoff(result.attempts - 1)
+		B.LogOut("Retrying " + site.Url + " in " + delay.Round(time.Millisecond).String() + ": " + err.Error())
+
+		if sleepContext(ctx, delay) != nil {
+			break
+		}
+	}
+
+	result.items = applySiteRules(site, fetched.items)
+	result.status = fetched.status
+	result.notModified = fetched.notModified
+	result.bytes = fetched.bytes
+	result.bytesSaved = fetched.bytesSaved
+	result.validators = fetched.validators
+	result.hub = fetched.hub
+	result.topic = fetched.topic
+	result.hint = fetched.hint
+	result.err = err
+
+	return result
+}
+
+func feedToItems(site Conf.Site, feed *gofeed.Feed) []*NewsItem {
+	return feedToItemsAt(site, feed, time.Now())
+}
+
+// feedToItemsAt dates items without a usable date at firstSeen, a reparse passes the time the body was fetched
+func feedToItemsAt(site Conf.Site, feed *gofeed.Feed, firstSeen time.Time) []*NewsItem {
+	var items []*NewsItem = []*NewsItem{}
+	for j := 0; j < len(feed.Items); j++ {
+		thumbnail, thumbnailOrigin := resolveThumbnail(feed.Items[j], feed)
+		published, dateOrigin := normalizeDate(site, feed.Items[j], firstSeen)
+
+		NewsItem := &NewsItem{
+			Source:          site.Title,
+			SiteUrl:         site.Url,
+			Title:           strings.TrimSpace(feed.Items[j].Title),
+			Description:     feed.Items[j].Description,
+			Content:         feed.Items[j].Content,
+			Link:            feed.Items[j].Link,
+			Published:       published.Format(time.RFC3339),
+			PublishedParsed: &published,
+			DateOrigin:      dateOrigin,
+			LinkImage:       thumbnail,
+			ThumbnailOrigin: thumbnailOrigin,
+			Guid:            feed.Items[j].GUID,
+			Language:        itemLanguage(site, feed.Language),
+			Category:        site.Category,
+			Authors:         feedAuthors(feed.Items[j]),
+			Tags:            feedTags(feed.Items[j]),
+			Enclosures:      feedEnclosures(feed.Items[j]),
+		}
+
+		items = append(items, NewsItem)
+	}
+
+	return items
+}
+
+func createTableIfNeeded(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS feed_items (
+		id SERIAL PRIMARY KEY,
+		title VARCHAR(500) NOT NULL,
+		description VARCHAR(1000) NOT NULL,
+		link VARCHAR(500) NOT NULL,
+		published timestamptz NOT NULL,
+		published_parsed timestamptz NOT NULL,
+		source VARCHAR(300) NOT NULL,
+		thumbnail VARCHAR(500),
+		uuid VARCHAR(300) NOT NULL,
+		guid VARCHAR(500) NOT NULL DEFAULT '',
+		canonical_link VARCHAR(500),
+		language VARCHAR(10),
+		category VARCHAR(100) NOT NULL DEFAULT '',
+		created timestamptz DEFAULT NOW(),
+		UNIQUE (uuid)
+	)`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func insertItem(db *sql.DB, item *NewsItem) int {
+	item.CanonicalId = findCanonicalItem(db, item)
+
+	var canonicalId sql.NullInt64
+	if item.CanonicalId > 0 {
+		canonicalId = sql.NullInt64{Int64: int64(item.CanonicalId), Valid: true}
+	}
+
+	query := "INSERT INTO feed_items (title, description, link, published, published_parsed, source, thumbnail, uuid, guid, canonical_link, simhash, canonical_id, content, thumbnail_origin, description_html, language, date_origin, category) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18) ON CONFLICT DO NOTHING RETURNING id"
+
+	var pk int
+	err := db.QueryRow(query, item.Title, item.Description, item.Link, item.Published, item.PublishedParsed, item.Source, item.LinkImage, item.Uuid, item.Guid, item.CanonicalLink, int64(item.Simhash), canonicalId, item.Content, item.ThumbnailOrigin, item.DescriptionHtml, item.Language, item.DateOrigin, item.Category).Scan(&pk)
+
+	if err != nil {
+		B.LogOut(err.Error() + " - duplicate uuid: " + item.Uuid)
+	} else {
+		B.LogOut("Inserted item (pk: " + strconv.Itoa(pk) + "): " + ellipticalTruncate(item.Title, 35))
+		if item.CanonicalId > 0 {
+			B.LogOut("Near duplicate of item " + strconv.Itoa(item.CanonicalId))
+		}
+	}
+
+	return pk
+}
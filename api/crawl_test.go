@@ -0,0 +1,162 @@
+// api/crawl_test.go
+package api
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	Conf "github.com/janevala/home_be/config"
+)
+
+// testDatabase opens TEST_DATABASE_URL in a schema of its own, dropped when the test ends. Without it the test is skipped.
+func testDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+
+	databaseUrl := os.Getenv("TEST_DATABASE_URL")
+	if databaseUrl == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := "home_be_test_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// lib/pq passes unknown connection parameters on as run-time settings
+	if strings.HasPrefix(databaseUrl, "postgres://") || strings.HasPrefix(databaseUrl, "postgresql://") {
+		u, err := url.Parse(databaseUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		databaseUrl = u.String()
+	} else {
+		databaseUrl += " search_path=" + schema
+	}
+
+	db, err := sql.Open("postgres", databaseUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// TestCrawlReplay crawls the fixtures in testdata/replay, recorded with the crawler record setting
+func TestCrawlReplay(t *testing.T) {
+	db := testDatabase(t)
+
+	crawler := Conf.CrawlerConfig{Replay: "testdata/replay"}
+	configurePoliteness(crawler)
+	t.Cleanup(func() { configurePoliteness(Conf.CrawlerConfig{}) })
+
+	sites := Conf.SitesConfig{Title: "Test", Sites: []Conf.Site{
+		{Title: "Example News", Url: "https://news.example.com/rss.xml", Category: "Local"},
+		{Title: "Example Blog", Url: "https://blog.example.org/feed.json", Type: sourceJsonFeed},
+		{Title: "Gone", Url: "https://gone.example.net/feed.xml"},
+		{Title: "Private", Url: "https://news.example.com/private/feed.xml"},
+	}}
+
+	type count struct {
+		Status     int
+		Items      int
+		Inserted   int
+		Revised    int
+		Failed     bool
+		Disallowed bool
+	}
+
+	counts := func(results []CrawlResult) map[string]count {
+		byUrl := make(map[string]count)
+		for _, result := range results {
+			byUrl[result.Url] = count{
+				Status:     result.Status,
+				Items:      result.Items,
+				Inserted:   result.Inserted,
+				Revised:    result.Revised,
+				Failed:     result.Err != nil,
+				Disallowed: result.Disallowed,
+			}
+		}
+		return byUrl
+	}
+
+	want := map[string]count{
+		"https://news.example.com/rss.xml":          {Status: 200, Items: 3, Inserted: 3},
+		"https://blog.example.org/feed.json":        {Status: 200, Items: 2, Inserted: 2},
+		"https://gone.example.net/feed.xml":         {Status: 404, Failed: true},
+		"https://news.example.com/private/feed.xml": {Failed: true, Disallowed: true},
+	}
+
+	if got := counts(crawl(t.Context(), sites, db, crawler)); !reflect.DeepEqual(got, want) {
+		t.Errorf("first crawl = %+v\nwant %+v", got, want)
+	}
+
+	// Replays never answer 304, the same items come again and change nothing
+	want["https://news.example.com/rss.xml"] = count{Status: 200, Items: 3}
+	want["https://blog.example.org/feed.json"] = count{Status: 200, Items: 2}
+	if got := counts(crawl(t.Context(), sites, db, crawler)); !reflect.DeepEqual(got, want) {
+		t.Errorf("second crawl = %+v\nwant %+v", got, want)
+	}
+
+	rows, err := db.Query("SELECT source, category, title, link FROM feed_items ORDER BY published_parsed DESC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var stored []string
+	for rows.Next() {
+		var source, category, title, link string
+		if err := rows.Scan(&source, &category, &title, &link); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, source+" | "+category+" | "+title+" | "+link)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	wantStored := []string{
+		"Example News | Local | Spring market returns to the square | https://news.example.com/2026/03/spring-market",
+		"Example News | Local | Library extends opening hours | https://news.example.com/2026/03/library-hours",
+		"Example News | Local | Harbour bridge closes for repairs | https://news.example.com/2026/03/bridge-repairs",
+		"Example Blog |  | Profiling Go services in production | https://blog.example.org/posts/profiling",
+		"Example Blog |  | Table driven tests | https://blog.example.org/posts/testing",
+	}
+	if !reflect.DeepEqual(stored, wantStored) {
+		t.Errorf("stored items = %q\nwant %q", stored, wantStored)
+	}
+
+	var etag string
+	if err := db.QueryRow("SELECT etag FROM feed_cache WHERE url = $1", "https://news.example.com/rss.xml").Scan(&etag); err != nil {
+		t.Fatal(err)
+	}
+	if etag != `"news-v1"` {
+		t.Errorf("cached ETag = %s, want \"news-v1\"", etag)
+	}
+}
@@ -0,0 +1,213 @@
+// api/dates.go
+package api
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+)
+
+// Where the date of an item came from, stored in feed_items.date_origin
+const (
+	dateFromPublished  = "published"
+	dateFromUpdated    = "updated"
+	dateFromDublinCore = "dublin-core"
+	dateFromLayout     = "layout"
+	dateFromFirstSeen  = "first-seen"
+
+	// Appended to the origin when a future date was replaced by the first-seen time
+	dateClamped = "-clamped"
+)
+
+const (
+	// Clock skew tolerated before a date counts as in the future
+	maxFutureSkew = 15 * time.Minute
+)
+
+// Anything earlier is a placeholder such as the zero time or 1970-01-01
+var minPlausibleDate = time.Date(1995, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Layouts seen in feeds that gofeed does not parse, tried after the site's own layouts
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.RFC822Z,
+	time.RFC822,
+	time.ANSIC,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 02 Jan 2006 15:04:05",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"Monday, January 2, 2006 - 15:04",
+	"January 2, 2006 15:04:05",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"02.01.2006 15:04",
+	"02.01.2006",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+}
+
+// normalizeDate picks the first plausible date of an item, falling back to when it was first seen.
+// The result is in UTC and never in the future.
+func normalizeDate(site Conf.Site, item *gofeed.Item, firstSeen time.Time) (time.Time, string) {
+	date, origin := itemDate(site, item)
+	if date.IsZero() {
+		return firstSeen.UTC(), dateFromFirstSeen
+	}
+
+	if date.After(firstSeen.Add(maxFutureSkew)) {
+		return firstSeen.UTC(), origin + dateClamped
+	}
+
+	return date.UTC(), origin
+}
+
+func itemDate(site Conf.Site, item *gofeed.Item) (time.Time, string) {
+	if plausibleDate(item.PublishedParsed) {
+		return *item.PublishedParsed, dateFromPublished
+	}
+
+	if plausibleDate(item.UpdatedParsed) {
+		return *item.UpdatedParsed, dateFromUpdated
+	}
+
+	for _, value := range dublinCoreDates(item) {
+		if t, ok := parseDate(value, site.DateLayouts); ok {
+			return t, dateFromDublinCore
+		}
+	}
+
+	for _, value := range []string{item.Published, item.Updated} {
+		if t, ok := parseDate(value, site.DateLayouts); ok {
+			return t, dateFromLayout
+		}
+	}
+
+	return time.Time{}, ""
+}
+
+// dublinCoreDates lists dc:date and the dcterms dates, publication dates first
+func dublinCoreDates(item *gofeed.Item) []string {
+	var values []string
+	if item.DublinCoreExt != nil {
+		values = append(values, item.DublinCoreExt.Date...)
+	}
+
+	for _, name := range []string{"issued", "created", "date", "modified"} {
+		for _, ext := range item.Extensions["dcterms"][name] {
+			values = append(values, ext.Value)
+		}
+	}
+
+	return values
+}
+
+func parseDate(value string, siteLayouts []string) (time.Time, bool) {
+	value = strings.Join(strings.Fields(value), " ")
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	for _, layouts := range [][]string{siteLayouts, dateLayouts} {
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, value); err == nil && plausibleDate(&t) {
+				return t, true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func plausibleDate(t *time.Time) bool {
+	return t != nil && !t.Before(minPlausibleDate)
+}
+
+// migrateDates moves the item dates to timestamptz. published held the wall clock time of the publisher with the
+// offset dropped, it is taken from published_parsed which was stored in UTC. created and extracted_at were written by
+// NOW() in the session time zone.
+func migrateDates(db *sql.DB) error {
+	parsedUsing := "published_parsed"
+	if dataType, err := columnType(db, "feed_items", "published_parsed"); err != nil {
+		return err
+	} else if dataType == "timestamp without time zone" {
+		parsedUsing = "published_parsed AT TIME ZONE 'UTC'"
+	}
+
+	// published first, its value comes from published_parsed before that column changes
+	columns := []struct {
+		name  string
+		using string
+	}{
+		{"published", parsedUsing},
+		{"published_parsed", parsedUsing},
+		{"created", "created::timestamptz"},
+		{"extracted_at", "extracted_at::timestamptz"},
+	}
+
+	for _, column := range columns {
+		if err := alterToTimestamptz(db, "feed_items", column.name, column.using); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec("ALTER TABLE feed_items ADD COLUMN IF NOT EXISTS date_origin VARCHAR(30) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateTimestamptz moves columns written by NOW() or from server time to timestamptz, read in the session time zone
+func migrateTimestamptz(db *sql.DB, table string, columns ...string) error {
+	for _, column := range columns {
+		if err := alterToTimestamptz(db, table, column, column+"::timestamptz"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// alterToTimestamptz converts a timestamp column, a missing or already converted one is left alone
+func alterToTimestamptz(db *sql.DB, table string, column string, using string) error {
+	dataType, err := columnType(db, table, column)
+	if err != nil || dataType != "timestamp without time zone" {
+		return err
+	}
+
+	if _, err := db.Exec("ALTER TABLE " + table + " ALTER COLUMN " + column + " TYPE timestamptz USING " + using); err != nil {
+		return err
+	}
+
+	B.LogOut("Migrated " + table + "." + column + " to timestamptz")
+	return nil
+}
+
+// columnType is the information_schema data type of a column, empty when the column does not exist
+func columnType(db *sql.DB, table string, column string) (string, error) {
+	var dataType string
+	err := db.QueryRow(`SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`, table, column).Scan(&dataType)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return dataType, err
+}
@@ -0,0 +1,237 @@
+// api/discover.go
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const discoverTimeout = 10 * time.Second
+
+// Link types that announce a feed in <link rel="alternate">
+var feedLinkTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+	"application/json":      true,
+	"application/rdf+xml":   true,
+	"application/xml":       true,
+	"text/xml":              true,
+}
+
+// Paths tried on the site root when the page announces nothing
+var commonFeedPaths = []string{
+	"/feed",
+	"/feed/",
+	"/rss",
+	"/rss.xml",
+	"/feed.xml",
+	"/atom.xml",
+	"/index.xml",
+	"/feed.json",
+	"/feeds/posts/default",
+}
+
+type FeedCandidate struct {
+	Site   Conf.Site `json:"site"`
+	Type   string    `json:"type"`
+	Items  int       `json:"items"`
+	Origin string    `json:"origin"`
+}
+
+// discoverFeeds collects feeds announced by the page and found on common paths, keeping only the ones gofeed can parse
+func discoverFeeds(ctx context.Context, homepage string) ([]FeedCandidate, error) {
+	if !strings.Contains(homepage, "://") {
+		homepage = "https://" + homepage
+	}
+
+	base, err := url.Parse(homepage)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := fetchPage(ctx, base.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// The url may already be a feed
+	if feed, err := newFeedParser().Parse(bytes.NewReader(page)); err == nil {
+		return []FeedCandidate{feedCandidate(base.String(), "", feed, "url")}, nil
+	}
+
+	var urls []string
+	origins := make(map[string]string)
+	titles := make(map[string]string)
+	add := func(u string, origin string, title string) {
+		if u == "" {
+			return
+		}
+		if _, seen := origins[u]; seen {
+			return
+		}
+		urls = append(urls, u)
+		origins[u] = origin
+		titles[u] = title
+	}
+
+	for _, link := range feedLinks(page) {
+		add(absoluteUrl(base, link.href), "link", link.title)
+	}
+
+	root := &url.URL{Scheme: base.Scheme, Host: base.Host}
+	for _, path := range commonFeedPaths {
+		add(absoluteUrl(root, path), "path", "")
+	}
+
+	candidates := make([]*FeedCandidate, len(urls))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, defaultMaxParallel)
+	for i, u := range urls {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(i int, u string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			fetchCtx, cancel := context.WithTimeout(ctx, discoverTimeout)
+			defer cancel()
+
+			feed, err := newFeedParser().ParseURLWithContext(u, fetchCtx)
+			if err != nil {
+				return
+			}
+
+			candidate := feedCandidate(u, titles[u], feed, origins[u])
+			candidates[i] = &candidate
+		}(i, u)
+	}
+
+	wg.Wait()
+
+	// Common paths often redirect to an announced feed, keep the first of each feed link
+	found := []FeedCandidate{}
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		if candidate == nil {
+			continue
+		}
+
+		key := candidate.Site.Url
+		if candidate.Site.HtmlUrl != "" {
+			key = candidate.Type + " " + candidate.Site.HtmlUrl + " " + candidate.Site.Title
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		found = append(found, *candidate)
+	}
+
+	return found, nil
+}
+
+func feedCandidate(u string, title string, feed *gofeed.Feed, origin string) FeedCandidate {
+	if feed.Title != "" {
+		title = strings.TrimSpace(feed.Title)
+	}
+
+	// gofeed reads JSON Feed too, the crawler needs to be told
+	siteType := ""
+	if feed.FeedType == "json" {
+		siteType = sourceJsonFeed
+	}
+
+	return FeedCandidate{
+		Site: Conf.Site{
+			Title:   title,
+			Url:     u,
+			HtmlUrl: feed.Link,
+			Type:    siteType,
+		},
+		Type:   feed.FeedType,
+		Items:  len(feed.Items),
+		Origin: origin,
+	}
+}
+
+type feedLink struct {
+	href  string
+	title string
+}
+
+// feedLinks returns the <link rel="alternate"> elements of a page that point to feeds
+func feedLinks(page []byte) []feedLink {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return nil
+	}
+
+	var links []feedLink
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Link {
+			rels := strings.Fields(strings.ToLower(attr(n, "rel")))
+			linkType := strings.ToLower(strings.TrimSpace(strings.Split(attr(n, "type"), ";")[0]))
+			for _, rel := range rels {
+				if rel == "alternate" && feedLinkTypes[linkType] {
+					links = append(links, feedLink{href: attr(n, "href"), title: attr(n, "title")})
+					break
+				}
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return links
+}
+
+func DiscoverHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			if !isAdmin(req) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			homepage := strings.TrimSpace(req.URL.Query().Get("url"))
+			if homepage == "" {
+				http.Error(w, "Missing url", http.StatusBadRequest)
+				return
+			}
+
+			candidates, err := discoverFeeds(req.Context(), homepage)
+			if err != nil {
+				B.LogErr(err)
+				http.Error(w, "Discovery error", http.StatusBadGateway)
+				return
+			}
+
+			responseJson, _ := json.Marshal(candidates)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
+		}
+	}
+}
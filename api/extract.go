@@ -0,0 +1,629 @@
+// api/extract.go
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	extractTimeout = 20 * time.Second
+	// Page jobs waiting for RunExtraction, a crawl queues one per new item
+	pageQueueSize = 1000
+)
+
+var errNoContent = errors.New("no article content found")
+
+var (
+	positiveHint = regexp.MustCompile(`(?i)article|body|content|entry|main|post|story|text`)
+	negativeHint = regexp.MustCompile(`(?i)comment|footer|sidebar|share|social|related|promo|sponsor|advert|banner|nav|menu|subscribe|newsletter|popup|cookie`)
+)
+
+// Elements that never hold article text
+var skippedTags = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Iframe:   true,
+	atom.Svg:      true,
+	atom.Form:     true,
+	atom.Nav:      true,
+	atom.Header:   true,
+	atom.Footer:   true,
+	atom.Aside:    true,
+	atom.Button:   true,
+	atom.Select:   true,
+	atom.Input:    true,
+	atom.Textarea: true,
+	atom.Canvas:   true,
+	atom.Template: true,
+	atom.Object:   true,
+	atom.Embed:    true,
+}
+
+// Elements kept in the cleaned html, everything else is unwrapped
+var articleTags = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.Ul:         true,
+	atom.Ol:         true,
+	atom.Li:         true,
+	atom.Blockquote: true,
+	atom.Pre:        true,
+	atom.Code:       true,
+	atom.Em:         true,
+	atom.Strong:     true,
+	atom.B:          true,
+	atom.I:          true,
+	atom.A:          true,
+	atom.Img:        true,
+	atom.Figure:     true,
+	atom.Figcaption: true,
+	atom.Br:         true,
+}
+
+// Elements that start a new paragraph in the plain text
+var blockTags = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.Div:        true,
+	atom.Section:    true,
+	atom.Article:    true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.Ul:         true,
+	atom.Ol:         true,
+	atom.Li:         true,
+	atom.Blockquote: true,
+	atom.Pre:        true,
+	atom.Figure:     true,
+	atom.Figcaption: true,
+	atom.Table:      true,
+	atom.Tr:         true,
+	atom.Br:         true,
+}
+
+type ArticleContent struct {
+	Id          int        `json:"id"`
+	Title       string     `json:"title"`
+	Link        string     `json:"link"`
+	Text        string     `json:"text"`
+	Html        string     `json:"html"`
+	ExtractedAt *time.Time `json:"extractedAt,omitempty"`
+}
+
+type extractedArticle struct {
+	Text string
+	Html string
+}
+
+// extractArticle finds the element holding the main text the way readability does: paragraphs
+// score their parents, class and id names nudge the score and link heavy blocks are penalized
+func extractArticle(page []byte, base *url.URL) (extractedArticle, error) {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return extractedArticle{}, err
+	}
+
+	pruneNodes(doc)
+
+	var candidates []*html.Node
+	scores := make(map[*html.Node]float64)
+	addScore := func(n *html.Node, score float64) {
+		if n == nil || n.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			candidates = append(candidates, n)
+			scores[n] = classWeight(n)
+		}
+		scores[n] += score
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && (n.DataAtom == atom.P || n.DataAtom == atom.Pre || n.DataAtom == atom.Td || n.DataAtom == atom.Blockquote) {
+			text := strings.TrimSpace(innerText(n))
+			if stringLength(text) >= 25 {
+				score := 1 + float64(strings.Count(text, ",")) + min(float64(stringLength(text))/100, 3)
+				addScore(n.Parent, score)
+				if n.Parent != nil {
+					addScore(n.Parent.Parent, score/2)
+				}
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	var best *html.Node
+	bestScore := 0.0
+	for _, candidate := range candidates {
+		score := scores[candidate] * (1 - linkDensity(candidate))
+		if best == nil || score > bestScore {
+			best = candidate
+			bestScore = score
+		}
+	}
+
+	if best == nil {
+		return extractedArticle{}, errNoContent
+	}
+
+	pruneBoilerplate(best)
+
+	var out strings.Builder
+	renderArticle(&out, best, base)
+
+	article := extractedArticle{
+		Text: articleText(best),
+		Html: strings.TrimSpace(out.String()),
+	}
+
+	if article.Text == "" {
+		return extractedArticle{}, errNoContent
+	}
+
+	return article, nil
+}
+
+func pruneNodes(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.CommentNode || (c.Type == html.ElementNode && (skippedTags[c.DataAtom] || isHidden(c))) {
+			n.RemoveChild(c)
+		} else {
+			pruneNodes(c)
+		}
+		c = next
+	}
+}
+
+// pruneBoilerplate drops share bars, tag lists and the like from inside the article: blocks whose names hint at
+// boilerplate and whose text is mostly links
+func pruneBoilerplate(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == html.ElementNode && !articleTags[c.DataAtom] && classWeight(c) < 0 && linkDensity(c) > 0.5 {
+			n.RemoveChild(c)
+		} else {
+			pruneBoilerplate(c)
+		}
+		c = next
+	}
+}
+
+func isHidden(n *html.Node) bool {
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "hidden":
+			return true
+		case "aria-hidden":
+			if a.Val == "true" {
+				return true
+			}
+		case "style":
+			style := strings.ReplaceAll(strings.ToLower(a.Val), " ", "")
+			if strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+
+	return ""
+}
+
+func classWeight(n *html.Node) float64 {
+	weight := 0.0
+	for _, name := range []string{attr(n, "class"), attr(n, "id")} {
+		if name == "" {
+			continue
+		}
+		if negativeHint.MatchString(name) {
+			weight -= 25
+		}
+		if positiveHint.MatchString(name) {
+			weight += 25
+		}
+	}
+
+	if n.DataAtom == atom.Article || n.DataAtom == atom.Main {
+		weight += 25
+	}
+
+	return weight
+}
+
+func innerText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	return sb.String()
+}
+
+func linkDensity(n *html.Node) float64 {
+	textLength := stringLength(strings.TrimSpace(innerText(n)))
+	if textLength == 0 {
+		return 0
+	}
+
+	linkLength := 0
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			linkLength += stringLength(strings.TrimSpace(innerText(n)))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	return min(float64(linkLength)/float64(textLength), 1)
+}
+
+// articleText flattens the element into paragraphs separated by blank lines
+func articleText(n *html.Node) string {
+	var paragraphs []string
+	var current strings.Builder
+
+	flush := func() {
+		if text := strings.Join(strings.Fields(current.String()), " "); text != "" {
+			paragraphs = append(paragraphs, text)
+		}
+		current.Reset()
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			current.WriteString(n.Data)
+		case html.ElementNode:
+			if blockTags[n.DataAtom] {
+				flush()
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+
+		if n.Type == html.ElementNode && blockTags[n.DataAtom] {
+			flush()
+		}
+	}
+	walk(n)
+	flush()
+
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// renderArticle writes the children of n keeping only article markup, links and images are made absolute
+func renderArticle(out *strings.Builder, n *html.Node, base *url.URL) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			out.WriteString(html.EscapeString(c.Data))
+		case html.ElementNode:
+			if !articleTags[c.DataAtom] {
+				renderArticle(out, c, base)
+				continue
+			}
+
+			if c.DataAtom == atom.Img {
+				src := absoluteUrl(base, attr(c, "src"))
+				if src == "" {
+					continue
+				}
+				out.WriteString(`<img src="` + html.EscapeString(src) + `"`)
+				if alt := attr(c, "alt"); alt != "" {
+					out.WriteString(` alt="` + html.EscapeString(alt) + `"`)
+				}
+				out.WriteString(">")
+				continue
+			}
+
+			out.WriteString("<" + c.Data)
+			if c.DataAtom == atom.A {
+				if href := absoluteUrl(base, attr(c, "href")); href != "" {
+					out.WriteString(` href="` + html.EscapeString(href) + `"`)
+				}
+			}
+			out.WriteString(">")
+
+			if c.DataAtom == atom.Br {
+				continue
+			}
+
+			renderArticle(out, c, base)
+			out.WriteString("</" + c.Data + ">")
+		}
+	}
+}
+
+// absoluteUrl resolves ref against base and only lets http(s) urls through
+func absoluteUrl(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+
+	return u.String()
+}
+
+func migrateArticleContent(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE feed_items
+		ADD COLUMN IF NOT EXISTS content TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS content_text TEXT,
+		ADD COLUMN IF NOT EXISTS content_html TEXT,
+		ADD COLUMN IF NOT EXISTS extracted_at timestamptz`)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// extractItem fetches the linked page and stores its main content, when the page cannot be used the feed content is tried instead
+func extractItem(ctx context.Context, db *sql.DB, id int, link string, content string) (extractedArticle, error) {
+	ctx, cancel := context.WithTimeout(ctx, extractTimeout)
+	defer cancel()
+
+	page, err := fetchPage(ctx, link)
+	return storeArticle(db, id, link, content, page, err)
+}
+
+// storeArticle stores the main content of a fetched page, or of the feed content when the fetch failed or the page has none
+func storeArticle(db *sql.DB, id int, link string, content string, page []byte, err error) (extractedArticle, error) {
+	base, _ := url.Parse(link)
+
+	var article extractedArticle
+	if err == nil {
+		article, err = extractArticle(page, base)
+	}
+
+	if err != nil && strings.TrimSpace(content) != "" {
+		B.LogOut("Extraction from page failed, using feed content: " + err.Error())
+		article, err = extractArticle([]byte("<div>"+content+"</div>"), base)
+	}
+
+	if err != nil {
+		return extractedArticle{}, err
+	}
+
+	_, err = db.Exec("UPDATE feed_items SET content_text = $1, content_html = $2, extracted_at = NOW() WHERE id = $3", article.Text, article.Html, id)
+	if err != nil {
+		return extractedArticle{}, err
+	}
+
+	return article, nil
+}
+
+// pageJob is what a new item needs from its linked page, the og:image as thumbnail, the main content or both.
+// The page is fetched once for either.
+type pageJob struct {
+	id        int
+	link      string
+	content   string
+	thumbnail bool
+	extract   bool
+}
+
+// pageJobs lists the new items that need their page, thumbnails replace channel level or missing images
+func pageJobs(items []*NewsItem, extract bool) []pageJob {
+	var jobs []pageJob
+	for _, item := range items {
+		thumbnail := item.ThumbnailOrigin == thumbnailFeed || item.ThumbnailOrigin == thumbnailNone
+		if !thumbnail && !extract {
+			continue
+		}
+
+		jobs = append(jobs, pageJob{id: item.Id, link: item.Link, content: item.Content, thumbnail: thumbnail, extract: extract})
+	}
+
+	return jobs
+}
+
+func runPageJob(ctx context.Context, db *sql.DB, job pageJob) {
+	ctx, cancel := context.WithTimeout(ctx, extractTimeout)
+	defer cancel()
+
+	page, err := fetchPage(ctx, job.link)
+
+	if job.thumbnail {
+		if err != nil {
+			B.LogOut("Thumbnail lookup failed for item " + strconv.Itoa(job.id) + ": " + err.Error())
+		} else {
+			savePageThumbnail(db, job.id, job.link, page)
+		}
+	}
+
+	if job.extract {
+		if _, err := storeArticle(db, job.id, job.link, job.content, page, err); err != nil {
+			B.LogOut("Extraction failed for item " + strconv.Itoa(job.id) + ": " + err.Error())
+		}
+	}
+}
+
+// runPageJobs runs the jobs before returning, at most parallel at a time
+func runPageJobs(ctx context.Context, db *sql.DB, jobs []pageJob, parallel int) {
+	sem := make(chan struct{}, max(parallel, 1))
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(job pageJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			runPageJob(ctx, db, job)
+		}(job)
+	}
+
+	wg.Wait()
+}
+
+// pageQueue holds the page jobs of crawled items for RunExtraction, storing items never waits on their pages
+var pageQueue = make(chan pageJob, pageQueueSize)
+
+// queuePageJobs never blocks, a job that does not fit is dropped and its item is extracted on demand by ArticleContentHandler
+func queuePageJobs(jobs []pageJob) {
+	for _, job := range jobs {
+		select {
+		case pageQueue <- job:
+		default:
+			B.LogOut("Page queue full, skipped item " + strconv.Itoa(job.id))
+		}
+	}
+}
+
+// RunExtraction works through the page jobs queued by crawls when extraction is on. It blocks until ctx is cancelled
+// and the jobs in progress have returned, jobs still queued then are left to on demand extraction.
+func RunExtraction(ctx context.Context, crawler Conf.CrawlerConfig, db *sql.DB) {
+	if !crawler.Extract {
+		return
+	}
+
+	var wg sync.WaitGroup
+	workers := maxParallel(crawler)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-pageQueue:
+					runPageJob(ctx, db, job)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func ArticleContentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			if !strings.Contains(req.URL.RawQuery, "code=123") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid"))
+				return
+			}
+
+			id := 0
+			if i := req.URL.Query().Get("id"); i != "" {
+				if i, err := strconv.Atoi(i); err == nil && i > 0 {
+					id = i
+				}
+			}
+
+			var article ArticleContent
+			var content string
+			err := db.QueryRow(
+				`SELECT id, title, link, content, COALESCE(content_text, ''), COALESCE(content_html, ''), extracted_at
+				FROM feed_items
+				WHERE id = $1`, id).Scan(&article.Id, &article.Title, &article.Link, &content, &article.Text, &article.Html, &article.ExtractedAt)
+
+			if err == sql.ErrNoRows {
+				http.Error(w, "Article not found", http.StatusNotFound)
+				return
+			}
+
+			if err != nil {
+				B.LogErr(err)
+				http.Error(w, "Database query error", http.StatusInternalServerError)
+				return
+			}
+
+			if article.ExtractedAt == nil {
+				extracted, err := extractItem(req.Context(), db, article.Id, article.Link, content)
+				if err != nil {
+					B.LogErr(err)
+					http.Error(w, "Extraction error", http.StatusBadGateway)
+					return
+				}
+
+				now := time.Now()
+				article.Text = extracted.Text
+				article.Html = extracted.Html
+				article.ExtractedAt = &now
+			}
+
+			responseJson, _ := json.Marshal(article)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
+		}
+	}
+}
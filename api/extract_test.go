@@ -0,0 +1,54 @@
+// api/extract_test.go
+package api
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The corpus in testdata/extract holds saved pages, <name>.txt is the main text expected from <name>.html
+func TestExtractArticle(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr error
+	}{
+		{name: "news"},
+		{name: "blog"},
+		{name: "links", wantErr: errNoContent},
+	}
+
+	base, _ := url.Parse("https://example.com/2026/03/story")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := os.ReadFile(filepath.Join("testdata", "extract", tt.name+".html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			article, err := extractArticle(page, base)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := os.ReadFile(filepath.Join("testdata", "extract", tt.name+".txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := article.Text; got != strings.TrimSpace(string(want)) {
+				t.Errorf("text = %q\nwant %q", got, strings.TrimSpace(string(want)))
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+// api/fetch.go
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Pages larger than this are cut off, article text is always well within it
+const maxPageBytes = 5 << 20
+
+var errBodyTooLarge = fmt.Errorf("body larger than %d bytes", maxPageBytes)
+
+// readBody reads a feed body of at most maxPageBytes. A feed cut short would not parse, so a larger one is an error.
+func readBody(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxPageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxPageBytes {
+		return nil, errBodyTooLarge
+	}
+
+	return body, nil
+}
+
+// fetchPage downloads an html page and converts it to UTF-8
+func fetchPage(ctx context.Context, link string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := crawlClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("fetch %s: %s", link, resp.Status)
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, maxPageBytes), resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(body)
+}
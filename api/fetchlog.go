@@ -0,0 +1,145 @@
+// api/fetchlog.go
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+)
+
+type SiteHealth struct {
+	Title               string     `json:"title"`
+	Url                 string     `json:"url"`
+	LastFetch           *time.Time `json:"lastFetch,omitempty"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastStatus          int        `json:"lastStatus"`
+	LastError           string     `json:"lastError,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	AvgItemsSeen        float64    `json:"avgItemsSeen"`
+	AvgItemsInserted    float64    `json:"avgItemsInserted"`
+	AvgLatencyMs        float64    `json:"avgLatencyMs"`
+}
+
+func createFetchLogTableIfNeeded(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS feed_fetch_log (
+		id SERIAL PRIMARY KEY,
+		crawl_id VARCHAR(50) NOT NULL,
+		site_title VARCHAR(300) NOT NULL,
+		site_url VARCHAR(500) NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		latency_ms INTEGER NOT NULL DEFAULT 0,
+		bytes BIGINT NOT NULL DEFAULT 0,
+		items_seen INTEGER NOT NULL DEFAULT 0,
+		items_inserted INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created timestamptz DEFAULT NOW()
+	)`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS feed_fetch_log_site_created ON feed_fetch_log (site_url, created DESC)")
+	if err != nil {
+		return err
+	}
+
+	return migrateTimestamptz(db, "feed_fetch_log", "created")
+}
+
+func insertFetchLog(db *sql.DB, crawlId string, result CrawlResult) {
+	query := `INSERT INTO feed_fetch_log (crawl_id, site_title, site_url, status, latency_ms, bytes, items_seen, items_inserted, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err := db.Exec(query, crawlId, result.Title, result.Url, result.Status, result.Duration.Milliseconds(), result.Bytes, result.Items, result.Inserted, result.Error)
+	if err != nil {
+		B.LogErr(err)
+	}
+}
+
+func siteHealth(db *sql.DB, sites Conf.SitesConfig) ([]SiteHealth, error) {
+	rows, err := db.Query(`
+		SELECT l.site_url,
+			MAX(l.created),
+			MAX(l.created) FILTER (WHERE l.error = ''),
+			COUNT(*) FILTER (WHERE l.error <> '' AND l.created > COALESCE(
+				(SELECT MAX(s.created) FROM feed_fetch_log s WHERE s.site_url = l.site_url AND s.error = ''), '1970-01-01')),
+			COALESCE(AVG(l.items_seen) FILTER (WHERE l.error = ''), 0),
+			COALESCE(AVG(l.items_inserted) FILTER (WHERE l.error = ''), 0),
+			COALESCE(AVG(l.latency_ms), 0)
+		FROM feed_fetch_log l
+		WHERE l.created > NOW() - INTERVAL '30 days'
+		GROUP BY l.site_url`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	byUrl := make(map[string]*SiteHealth)
+	for rows.Next() {
+		var health SiteHealth
+		err := rows.Scan(&health.Url, &health.LastFetch, &health.LastSuccess, &health.ConsecutiveFailures, &health.AvgItemsSeen, &health.AvgItemsInserted, &health.AvgLatencyMs)
+		if err != nil {
+			return nil, err
+		}
+
+		byUrl[health.Url] = &health
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	healths := []SiteHealth{}
+	for _, site := range sites.Sites {
+		health, ok := byUrl[site.Url]
+		if !ok {
+			health = &SiteHealth{Url: site.Url}
+		}
+
+		health.Title = site.Title
+
+		err := db.QueryRow("SELECT status, error FROM feed_fetch_log WHERE site_url = $1 ORDER BY created DESC LIMIT 1", site.Url).Scan(&health.LastStatus, &health.LastError)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		healths = append(healths, *health)
+	}
+
+	return healths, nil
+}
+
+func SiteHealthHandler(store *SiteStore, db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			if !strings.Contains(req.URL.RawQuery, "code=123") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid"))
+				return
+			}
+
+			healths, err := siteHealth(db, store.Sites())
+			if err != nil {
+				B.LogErr(err)
+				http.Error(w, "Database query error", http.StatusInternalServerError)
+				return
+			}
+
+			responseJson, _ := json.Marshal(healths)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
+		}
+	}
+}
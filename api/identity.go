@@ -0,0 +1,160 @@
+// api/identity.go
+package api
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+
+	B "github.com/janevala/home_be/build"
+)
+
+// Query parameters that only track where a click came from and never change the article
+var trackingParams = map[string]bool{
+	"fbclid":     true,
+	"gclid":      true,
+	"dclid":      true,
+	"msclkid":    true,
+	"mc_cid":     true,
+	"mc_eid":     true,
+	"igshid":     true,
+	"ref":        true,
+	"ref_src":    true,
+	"ref_url":    true,
+	"cmpid":      true,
+	"ncid":       true,
+	"_ga":        true,
+	"_gl":        true,
+	"guccounter": true,
+	"taid":       true,
+	"smid":       true,
+}
+
+// canonicalizeLink drops tracking parameters and fragments and normalizes scheme, host and trailing slash,
+// links that do not parse as absolute http(s) urls are returned trimmed but otherwise untouched
+func canonicalizeLink(link string) string {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return ""
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return link
+	}
+
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host = host + ":" + port
+	}
+
+	query := u.Query()
+	for key := range query {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "utm_") || trackingParams[lower] {
+			query.Del(key)
+		}
+	}
+
+	path := strings.TrimRight(u.EscapedPath(), "/")
+	if path == "" {
+		path = "/"
+	}
+
+	canonical := "https://" + host + path
+	if encoded := query.Encode(); encoded != "" {
+		canonical += "?" + encoded
+	}
+
+	return canonical
+}
+
+// itemIdentity prefers the feed GUID, then the canonical link and finally a hash of the content,
+// always scoped by source so two feeds cannot claim each other's items
+func itemIdentity(source string, guid string, link string, title string, description string) string {
+	var key string
+
+	if guid = strings.TrimSpace(guid); guid != "" {
+		key = "guid\x00" + guid
+	} else if canonical := canonicalizeLink(link); canonical != "" {
+		key = "link\x00" + canonical
+	} else {
+		key = "content\x00" + strings.ToLower(strings.Join(strings.Fields(title+" "+description), " "))
+	}
+
+	sum := sha256.Sum256([]byte(source + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// migrateItemIdentity rekeys rows stored with the old title based uuid, rows whose new key is already taken keep their old one
+func migrateItemIdentity(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE feed_items
+		ADD COLUMN IF NOT EXISTS guid VARCHAR(500) NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS canonical_link VARCHAR(500)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS feed_items_source_canonical_link ON feed_items (source, canonical_link)")
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT id, source, link, title, description FROM feed_items WHERE canonical_link IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	type legacyItem struct {
+		id          int
+		source      string
+		link        string
+		title       string
+		description string
+	}
+
+	var legacy []legacyItem
+	for rows.Next() {
+		var item legacyItem
+		if err := rows.Scan(&item.id, &item.source, &item.link, &item.title, &item.description); err != nil {
+			rows.Close()
+			return err
+		}
+
+		legacy = append(legacy, item)
+	}
+
+	rows.Close()
+
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	B.LogOut("Rekeying " + strconv.Itoa(len(legacy)) + " feed items")
+
+	for _, item := range legacy {
+		canonical := canonicalizeLink(item.link)
+		newUuid := itemIdentity(item.source, "", item.link, item.title, item.description)
+
+		_, err := db.Exec("UPDATE feed_items SET uuid = $1, canonical_link = $2 WHERE id = $3", newUuid, canonical, item.id)
+		if err != nil {
+			B.LogOut("Rekey conflict for item " + strconv.Itoa(item.id) + ": " + err.Error())
+
+			_, err = db.Exec("UPDATE feed_items SET canonical_link = $1 WHERE id = $2", canonical, item.id)
+			if err != nil {
+				B.LogErr(err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+// api/links.go
+package api
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// headerLinks reads the Link headers of a response into absolute urls by relation, the first link of a relation wins
+func headerLinks(base *url.URL, header http.Header) map[string]string {
+	links := make(map[string]string)
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			link = strings.TrimSpace(link)
+			end := strings.IndexByte(link, '>')
+			if !strings.HasPrefix(link, "<") || end < 0 {
+				continue
+			}
+
+			target := link[1:end]
+			for _, param := range strings.Split(link[end+1:], ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.ToLower(strings.TrimSpace(key)) != "rel" {
+					continue
+				}
+
+				for _, rel := range strings.Fields(strings.ToLower(strings.Trim(value, `"`))) {
+					if links[rel] == "" {
+						links[rel] = absoluteUrl(base, target)
+					}
+				}
+			}
+		}
+	}
+
+	return links
+}
+
+// documentLinks reads the feed level link elements, atom:link in RSS and link in Atom
+func documentLinks(base *url.URL, body []byte) map[string]string {
+	links := make(map[string]string)
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return links
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch strings.ToLower(start.Name.Local) {
+		case "item", "entry":
+			return links
+
+		case "link":
+			var rel, href string
+			for _, attr := range start.Attr {
+				switch strings.ToLower(attr.Name.Local) {
+				case "rel":
+					rel = strings.ToLower(attr.Value)
+				case "href":
+					href = attr.Value
+				}
+			}
+
+			for _, r := range strings.Fields(rel) {
+				if links[r] == "" {
+					links[r] = absoluteUrl(base, href)
+				}
+			}
+		}
+	}
+}
+
+// pageLinks merges both, Link headers take precedence over links in the document
+func pageLinks(base *url.URL, header http.Header, body []byte) map[string]string {
+	links := documentLinks(base, body)
+	for rel, target := range headerLinks(base, header) {
+		if target != "" {
+			links[rel] = target
+		}
+	}
+
+	return links
+}
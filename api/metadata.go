@@ -0,0 +1,291 @@
+// api/metadata.go
+package api
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	B "github.com/janevala/home_be/build"
+	"github.com/lib/pq"
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	maxAuthorLength    = 200
+	maxTagLength       = 100
+	maxEnclosureLength = 1000
+)
+
+type Enclosure struct {
+	Url    string `json:"url"`
+	Type   string `json:"type,omitempty"`
+	Length int64  `json:"length,omitempty"`
+}
+
+func migrateItemMetadata(db *sql.DB) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS authors (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(200) NOT NULL,
+			email VARCHAR(200) NOT NULL DEFAULT '',
+			UNIQUE (name, email)
+		)`,
+		`CREATE TABLE IF NOT EXISTS feed_item_authors (
+			item_id INT NOT NULL REFERENCES feed_items(id) ON DELETE CASCADE,
+			author_id INT NOT NULL REFERENCES authors(id) ON DELETE CASCADE,
+			position SMALLINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (item_id, author_id)
+		)`,
+		"CREATE INDEX IF NOT EXISTS feed_item_authors_author_idx ON feed_item_authors (author_id)",
+		`CREATE TABLE IF NOT EXISTS tags (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			slug VARCHAR(100) NOT NULL UNIQUE
+		)`,
+		`CREATE TABLE IF NOT EXISTS feed_item_tags (
+			item_id INT NOT NULL REFERENCES feed_items(id) ON DELETE CASCADE,
+			tag_id INT NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+			position SMALLINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (item_id, tag_id)
+		)`,
+		"CREATE INDEX IF NOT EXISTS feed_item_tags_tag_idx ON feed_item_tags (tag_id)",
+		`CREATE TABLE IF NOT EXISTS enclosures (
+			id SERIAL PRIMARY KEY,
+			item_id INT NOT NULL REFERENCES feed_items(id) ON DELETE CASCADE,
+			url VARCHAR(1000) NOT NULL,
+			type VARCHAR(100) NOT NULL DEFAULT '',
+			length BIGINT NOT NULL DEFAULT 0,
+			UNIQUE (item_id, url)
+		)`,
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// itemAuthors prefers the authors list, older feeds only have the single author or dc:creator
+func itemAuthors(item *gofeed.Item) []*gofeed.Person {
+	if len(item.Authors) > 0 {
+		return item.Authors
+	}
+
+	if item.Author != nil {
+		return []*gofeed.Person{item.Author}
+	}
+
+	if item.DublinCoreExt != nil {
+		var people []*gofeed.Person
+		for _, name := range item.DublinCoreExt.Creator {
+			people = append(people, &gofeed.Person{Name: name})
+		}
+		return people
+	}
+
+	return nil
+}
+
+func feedAuthors(item *gofeed.Item) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, person := range itemAuthors(item) {
+		if person == nil {
+			continue
+		}
+
+		name := truncateRunes(plainText(person.Name), maxAuthorLength)
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+
+		seen[strings.ToLower(name)] = true
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func feedTags(item *gofeed.Item) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, category := range item.Categories {
+		tag := truncateRunes(plainText(category), maxTagLength)
+		if tag == "" || seen[tagSlug(tag)] {
+			continue
+		}
+
+		seen[tagSlug(tag)] = true
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+func feedEnclosures(item *gofeed.Item) []Enclosure {
+	seen := make(map[string]bool)
+	var enclosures []Enclosure
+	for _, enclosure := range item.Enclosures {
+		if enclosure == nil {
+			continue
+		}
+
+		link := strings.TrimSpace(enclosure.URL)
+		if link == "" || len(link) > maxEnclosureLength || seen[link] {
+			continue
+		}
+
+		seen[link] = true
+		length, _ := strconv.ParseInt(strings.TrimSpace(enclosure.Length), 10, 64)
+		enclosures = append(enclosures, Enclosure{
+			Url:    link,
+			Type:   truncateRunes(strings.TrimSpace(enclosure.Type), 100),
+			Length: max(length, 0),
+		})
+	}
+
+	return enclosures
+}
+
+// tagSlug is what ?tag= matches against, case and surrounding space do not matter
+func tagSlug(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+func truncateRunes(s string, maxRunes int) string {
+	runes := []rune(strings.TrimSpace(s))
+	if len(runes) > maxRunes {
+		return strings.TrimSpace(string(runes[:maxRunes]))
+	}
+
+	return string(runes)
+}
+
+// insertItemMetadata links the authors, tags and enclosures of a freshly inserted item
+func insertItemMetadata(db *sql.DB, item *NewsItem) {
+	for position, name := range item.Authors {
+		var authorId int
+		err := db.QueryRow(`INSERT INTO authors (name) VALUES ($1)
+			ON CONFLICT (name, email) DO UPDATE SET name = EXCLUDED.name RETURNING id`, name).Scan(&authorId)
+		if err != nil {
+			B.LogErr(err)
+			continue
+		}
+
+		_, err = db.Exec("INSERT INTO feed_item_authors (item_id, author_id, position) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", item.Id, authorId, position)
+		if err != nil {
+			B.LogErr(err)
+		}
+	}
+
+	for position, tag := range item.Tags {
+		var tagId int
+		err := db.QueryRow(`INSERT INTO tags (name, slug) VALUES ($1, $2)
+			ON CONFLICT (slug) DO UPDATE SET slug = EXCLUDED.slug RETURNING id`, tag, tagSlug(tag)).Scan(&tagId)
+		if err != nil {
+			B.LogErr(err)
+			continue
+		}
+
+		_, err = db.Exec("INSERT INTO feed_item_tags (item_id, tag_id, position) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", item.Id, tagId, position)
+		if err != nil {
+			B.LogErr(err)
+		}
+	}
+
+	for _, enclosure := range item.Enclosures {
+		_, err := db.Exec("INSERT INTO enclosures (item_id, url, type, length) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+			item.Id, enclosure.Url, enclosure.Type, enclosure.Length)
+		if err != nil {
+			B.LogErr(err)
+		}
+	}
+}
+
+// attachItemMetadata fills the authors, tags and enclosures of items read from the database
+func attachItemMetadata(db *sql.DB, items []NewsItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(items))
+	byId := make(map[int][]int)
+	for i, item := range items {
+		ids[i] = int64(item.Id)
+		byId[item.Id] = append(byId[item.Id], i)
+	}
+
+	rows, err := db.Query(`SELECT fa.item_id, a.name FROM feed_item_authors fa
+		JOIN authors a ON a.id = fa.author_id
+		WHERE fa.item_id = ANY($1)
+		ORDER BY fa.item_id, fa.position`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, i := range byId[id] {
+			items[i].Authors = append(items[i].Authors, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`SELECT ft.item_id, t.name FROM feed_item_tags ft
+		JOIN tags t ON t.id = ft.tag_id
+		WHERE ft.item_id = ANY($1)
+		ORDER BY ft.item_id, ft.position`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, i := range byId[id] {
+			items[i].Tags = append(items[i].Tags, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`SELECT item_id, url, type, length FROM enclosures
+		WHERE item_id = ANY($1)
+		ORDER BY item_id, id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var enclosure Enclosure
+		if err := rows.Scan(&id, &enclosure.Url, &enclosure.Type, &enclosure.Length); err != nil {
+			return err
+		}
+		for _, i := range byId[id] {
+			items[i].Enclosures = append(items[i].Enclosures, enclosure)
+		}
+	}
+
+	return rows.Err()
+}
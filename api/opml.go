@@ -0,0 +1,187 @@
+// api/opml.go
+package api
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+)
+
+const maxOpmlBytes = 5 << 20
+
+// OPML 2.0, http://opml.org/spec2.opml
+type opml struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    opmlHead `xml:"head"`
+	Body    opmlBody `xml:"body"`
+}
+
+type opmlHead struct {
+	Title       string `xml:"title,omitempty"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type opmlBody struct {
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XmlUrl   string        `xml:"xmlUrl,attr,omitempty"`
+	HtmlUrl  string        `xml:"htmlUrl,attr,omitempty"`
+	Category string        `xml:"category,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+type OpmlImport struct {
+	Found   int `json:"found"`
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Sites   int `json:"sites"`
+}
+
+// parseOpml returns the feeds of an OPML document, outlines without xmlUrl are folders and name the category of the feeds inside
+func parseOpml(r io.Reader) ([]Conf.Site, error) {
+	var doc opml
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var sites []Conf.Site
+	var walk func(outlines []opmlOutline, folder []string)
+	walk = func(outlines []opmlOutline, folder []string) {
+		for _, outline := range outlines {
+			title := strings.TrimSpace(outline.Title)
+			if title == "" {
+				title = strings.TrimSpace(outline.Text)
+			}
+
+			xmlUrl := strings.TrimSpace(outline.XmlUrl)
+			if xmlUrl == "" {
+				if title != "" {
+					walk(outline.Outlines, append(folder[:len(folder):len(folder)], title))
+				} else {
+					walk(outline.Outlines, folder)
+				}
+				continue
+			}
+
+			category := strings.Join(folder, "/")
+			if category == "" {
+				category = strings.Trim(strings.Split(outline.Category, ",")[0], "/ ")
+			}
+
+			sites = append(sites, Conf.Site{
+				Title:    title,
+				Url:      xmlUrl,
+				HtmlUrl:  strings.TrimSpace(outline.HtmlUrl),
+				Category: category,
+			})
+		}
+	}
+	walk(doc.Body.Outlines, nil)
+
+	return sites, nil
+}
+
+// writeOpml puts the sites of each category into a folder outline, in order of first appearance
+func writeOpml(sites Conf.SitesConfig) ([]byte, error) {
+	doc := opml{
+		Version: "2.0",
+		Head: opmlHead{
+			Title:       sites.Title,
+			DateCreated: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+
+	folders := make(map[string]int)
+	for _, site := range sites.Sites {
+		outline := opmlOutline{
+			Text:    site.Title,
+			Title:   site.Title,
+			Type:    "rss",
+			XmlUrl:  site.Url,
+			HtmlUrl: site.HtmlUrl,
+		}
+
+		if site.Category == "" {
+			doc.Body.Outlines = append(doc.Body.Outlines, outline)
+			continue
+		}
+
+		i, ok := folders[site.Category]
+		if !ok {
+			i = len(doc.Body.Outlines)
+			folders[site.Category] = i
+			doc.Body.Outlines = append(doc.Body.Outlines, opmlOutline{Text: site.Category, Title: site.Category})
+		}
+
+		doc.Body.Outlines[i].Outlines = append(doc.Body.Outlines[i].Outlines, outline)
+	}
+
+	body, err := xml.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), body...), nil
+}
+
+func SitesOpmlHandler(store *SiteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			if !strings.Contains(req.URL.RawQuery, "code=123") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid"))
+				return
+			}
+
+			body, err := writeOpml(store.Sites())
+			if err != nil {
+				B.LogErr(err)
+				http.Error(w, "OPML error", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(body)
+
+		case http.MethodPost:
+			if !isAdmin(req) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			sites, err := parseOpml(io.LimitReader(req.Body, maxOpmlBytes))
+			if err != nil {
+				http.Error(w, "Invalid OPML", http.StatusBadRequest)
+				return
+			}
+
+			result := OpmlImport{Found: len(sites)}
+			result.Added, result.Updated = store.Merge(sites)
+			result.Sites = len(store.Sites().Sites)
+
+			B.LogOut(fmt.Sprintf("OPML import: %d found, %d added, %d updated", result.Found, result.Added, result.Updated))
+
+			responseJson, _ := json.Marshal(result)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+// api/polite.go
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	// Its product token, home_be, is what User-agent lines of robots.txt are matched against
+	defaultUserAgent = "home_be/1.0 (+https://techeavy.news)"
+
+	defaultHostDelay    = 500 * time.Millisecond
+	defaultHostParallel = 2
+	// Crawl-delay above this is capped, a feed fetch has to fit in the site timeout
+	maxCrawlDelay = 10 * time.Second
+
+	robotsTimeout  = 10 * time.Second
+	robotsTtl      = 24 * time.Hour
+	robotsErrorTtl = 10 * time.Minute
+	maxRobotsBytes = 512 << 10
+)
+
+var (
+	errDisallowed        = errors.New("disallowed by robots.txt")
+	errUnsupportedScheme = errors.New("unsupported url scheme")
+)
+
+// politeness sits under every outgoing crawler request, see crawlClient
+var politeness = &politeTransport{
+	base:      crawlTransport("", ""),
+	userAgent: defaultUserAgent,
+	delay:     defaultHostDelay,
+	parallel:  defaultHostParallel,
+	hosts:     make(map[string]*hostState),
+}
+
+// crawlClient is used for feeds, pages and discovery instead of http.DefaultClient. Links come from feeds and pages,
+// so it fetches http(s) only and does not follow a redirect anywhere else.
+var crawlClient = &http.Client{
+	Transport: politeness,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("%w: redirect to %s", errUnsupportedScheme, req.URL.Scheme)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		return nil
+	},
+}
+
+// politeTransport honours robots.txt, spaces requests to a host and limits how many run at once
+type politeTransport struct {
+	mu        sync.Mutex
+	base      http.RoundTripper
+	userAgent string
+	delay     time.Duration
+	parallel  int
+	hosts     map[string]*hostState
+	// Replayed fixtures are served without waiting, nothing reaches the hosts
+	replay bool
+
+	disallowed atomic.Int64
+}
+
+type hostState struct {
+	slots chan struct{}
+	// Earliest start of the next request
+	next time.Time
+
+	robotsMu      sync.Mutex
+	robots        *robotsRules
+	robotsExpires time.Time
+}
+
+// configurePoliteness applies the crawler settings, hosts seen before keep their concurrency limit
+func configurePoliteness(crawler Conf.CrawlerConfig) {
+	politeness.mu.Lock()
+	defer politeness.mu.Unlock()
+
+	politeness.userAgent = defaultUserAgent
+	if crawler.UserAgent != "" {
+		politeness.userAgent = crawler.UserAgent
+	}
+
+	politeness.delay = defaultHostDelay
+	if crawler.HostDelay > 0 {
+		politeness.delay = time.Duration(crawler.HostDelay) * time.Millisecond
+	}
+
+	politeness.parallel = defaultHostParallel
+	if crawler.HostParallel > 0 {
+		politeness.parallel = crawler.HostParallel
+	}
+
+	politeness.base = crawlTransport(crawler.Record, crawler.Replay)
+	politeness.replay = crawler.Replay != ""
+}
+
+// newFeedParser returns a gofeed parser that fetches through crawlClient
+func newFeedParser() *gofeed.Parser {
+	parser := gofeed.NewParser()
+	parser.Client = crawlClient
+
+	politeness.mu.Lock()
+	parser.UserAgent = politeness.userAgent
+	politeness.mu.Unlock()
+
+	return parser
+}
+
+// Disallowed counts the requests refused by robots.txt since startup
+func (t *politeTransport) Disallowed() int64 {
+	return t.disallowed.Load()
+}
+
+// settings reads what configurePoliteness may change while requests are running
+func (t *politeTransport) settings() (http.RoundTripper, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.base, t.userAgent
+}
+
+// hostParallel is how many requests to one host run at once
+func (t *politeTransport) hostParallel() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.parallel
+}
+
+func (t *politeTransport) host(host string) *hostState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.hosts[host]
+	if !ok {
+		state = &hostState{slots: make(chan struct{}, t.parallel)}
+		t.hosts[host] = state
+	}
+
+	return state
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedScheme, req.URL.Scheme)
+	}
+
+	base, userAgent := t.settings()
+
+	ctx := req.Context()
+
+	req = req.Clone(ctx)
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	state := t.host(strings.ToLower(req.URL.Host))
+
+	rules, err := t.robots(ctx, req.URL, state, base, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	if !rules.allowed(req.URL) {
+		t.disallowed.Add(1)
+		B.LogOut("Disallowed by robots.txt: " + req.URL.String())
+		return nil, fmt.Errorf("%w: %s", errDisallowed, req.URL.Redacted())
+	}
+
+	select {
+	case state.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	release := func() { once.Do(func() { <-state.slots }) }
+
+	if err := t.wait(ctx, state, rules.crawlDelay); err != nil {
+		release()
+		return nil, err
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// The slot is held until the body has been read and closed
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// wait reserves the next start time of the host and sleeps until it
+func (t *politeTransport) wait(ctx context.Context, state *hostState, crawlDelay time.Duration) error {
+	t.mu.Lock()
+	if t.replay {
+		t.mu.Unlock()
+		return nil
+	}
+
+	delay := max(t.delay, min(crawlDelay, maxCrawlDelay))
+	start := time.Now()
+	if state.next.After(start) {
+		start = state.next
+	}
+	state.next = start.Add(delay)
+	t.mu.Unlock()
+
+	wait := time.Until(start)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// robots returns the cached rules of the host, fetching robots.txt when they have expired. The error is that of
+// a cancelled request, nothing is cached for it.
+func (t *politeTransport) robots(ctx context.Context, u *url.URL, state *hostState, base http.RoundTripper, userAgent string) (*robotsRules, error) {
+	state.robotsMu.Lock()
+	defer state.robotsMu.Unlock()
+
+	if state.robots != nil && time.Now().Before(state.robotsExpires) {
+		return state.robots, nil
+	}
+
+	rules, ttl := fetchRobots(ctx, u, base, userAgent)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	state.robots = rules
+	state.robotsExpires = time.Now().Add(ttl)
+
+	return rules, nil
+}
+
+// fetchRobots follows RFC 9309: a missing file allows everything, an unreachable one disallows everything for a while
+func fetchRobots(ctx context.Context, u *url.URL, base http.RoundTripper, userAgent string) (*robotsRules, time.Duration) {
+	robotsUrl := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"}).String()
+
+	fetchCtx, cancel := context.WithTimeout(ctx, robotsTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, robotsUrl, nil)
+	if err != nil {
+		return &robotsRules{}, robotsErrorTtl
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+
+	// Redirects are followed, robots.txt of a host often moves to https or www
+	client := &http.Client{Transport: base}
+	resp, err := client.Do(req)
+	if err != nil {
+		// A cancelled request is not the host's fault, robots drops the result
+		if ctx.Err() == nil {
+			B.LogOut("robots.txt unreachable: " + robotsUrl + ": " + err.Error())
+		}
+		return &robotsRules{disallowAll: true}, robotsErrorTtl
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return &robotsRules{disallowAll: true}, robotsErrorTtl
+	case resp.StatusCode >= 400:
+		return &robotsRules{}, robotsTtl
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return &robotsRules{}, robotsErrorTtl
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRobotsBytes))
+	if err != nil {
+		return &robotsRules{disallowAll: true}, robotsErrorTtl
+	}
+
+	return parseRobots(string(body), robotsToken(userAgent)), robotsTtl
+}
+
+// robotsToken is the product token of a User-Agent, "home_be/1.0 (+https://techeavy.news)" is matched as home_be
+func robotsToken(userAgent string) string {
+	fields := strings.Fields(userAgent)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	token, _, _ := strings.Cut(fields[0], "/")
+	return token
+}
+
+type robotsRules struct {
+	disallowAll bool
+	rules       []robotsRule
+	crawlDelay  time.Duration
+}
+
+type robotsRule struct {
+	allow   bool
+	length  int
+	pattern *regexp.Regexp
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// parseRobots keeps the groups naming the agent, or the * groups when none does
+func parseRobots(body string, agent string) *robotsRules {
+	var groups []*robotsGroup
+	var current *robotsGroup
+	inRules := false
+
+	for _, line := range strings.Split(body, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if current == nil || inRules {
+				current = &robotsGroup{}
+				groups = append(groups, current)
+				inRules = false
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+
+		case "allow", "disallow":
+			if current == nil {
+				continue
+			}
+			inRules = true
+
+			if value == "" {
+				continue
+			}
+
+			current.rules = append(current.rules, robotsRule{
+				allow:   key == "allow",
+				length:  len(value),
+				pattern: robotsPattern(value),
+			})
+
+		case "crawl-delay":
+			if current == nil {
+				continue
+			}
+			inRules = true
+
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				current.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+
+	agent = strings.ToLower(agent)
+
+	matched := &robotsRules{}
+	wildcard := &robotsRules{}
+	found := false
+	for _, group := range groups {
+		for _, name := range group.agents {
+			target := wildcard
+			if name == agent {
+				target = matched
+				found = true
+			} else if name != "*" {
+				continue
+			}
+
+			target.rules = append(target.rules, group.rules...)
+			target.crawlDelay = max(target.crawlDelay, group.crawlDelay)
+			break
+		}
+	}
+
+	if found {
+		return matched
+	}
+
+	return wildcard
+}
+
+// robotsPattern turns a path pattern with * and a trailing $ into an anchored regexp
+func robotsPattern(value string) *regexp.Regexp {
+	end := strings.HasSuffix(value, "$")
+	value = strings.TrimSuffix(value, "$")
+
+	pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(value), `\*`, ".*")
+	if end {
+		pattern += "$"
+	}
+
+	return regexp.MustCompile(pattern)
+}
+
+// allowed applies the longest matching rule, allow wins a tie
+func (r *robotsRules) allowed(u *url.URL) bool {
+	if r.disallowAll {
+		return false
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if path == "/robots.txt" {
+		return true
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	allow := true
+	longest := -1
+	for _, rule := range r.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+
+		if rule.length > longest || (rule.length == longest && rule.allow) {
+			longest = rule.length
+			allow = rule.allow
+		}
+	}
+
+	return allow
+}
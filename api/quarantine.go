@@ -0,0 +1,269 @@
+// api/quarantine.go
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+)
+
+const (
+	defaultQuarantineAfter = 5
+	defaultQuarantineProbe = 6 * time.Hour
+	maxQuarantineProbe     = 7 * 24 * time.Hour
+)
+
+// Quarantine is the failure state of a site, kept across restarts in site_quarantine
+type Quarantine struct {
+	Url                 string     `json:"url"`
+	Title               string     `json:"title"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Quarantined         bool       `json:"quarantined"`
+	QuarantinedAt       *time.Time `json:"quarantinedAt,omitempty"`
+	ProbeInterval       string     `json:"probeInterval,omitempty"`
+	NextProbe           *time.Time `json:"nextProbe,omitempty"`
+	LastError           string     `json:"lastError"`
+}
+
+func createQuarantineTableIfNeeded(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS site_quarantine (
+		url VARCHAR(500) PRIMARY KEY,
+		failures INT NOT NULL DEFAULT 0,
+		quarantined_at timestamptz,
+		probe_minutes INT NOT NULL DEFAULT 0,
+		next_probe timestamptz,
+		last_error TEXT NOT NULL DEFAULT '',
+		updated timestamptz DEFAULT NOW()
+	)`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	return migrateTimestamptz(db, "site_quarantine", "quarantined_at", "next_probe", "updated")
+}
+
+// loadQuarantine restores the failure state of the schedules, called before Run starts
+func (s *Scheduler) loadQuarantine() {
+	rows, err := s.db.Query("SELECT url, failures, quarantined_at, probe_minutes, next_probe, last_error FROM site_quarantine")
+	if err != nil {
+		B.LogErr(err)
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var url, lastError string
+		var failures, probeMinutes int
+		var quarantinedAt, nextProbe sql.NullTime
+		if err := rows.Scan(&url, &failures, &quarantinedAt, &probeMinutes, &nextProbe, &lastError); err != nil {
+			B.LogErr(err)
+			return
+		}
+
+		schedule, ok := s.schedules[url]
+		if !ok {
+			continue
+		}
+
+		schedule.ConsecutiveFailures = failures
+		schedule.LastError = lastError
+		if quarantinedAt.Valid {
+			schedule.Quarantined = true
+			schedule.QuarantinedAt = quarantinedAt.Time
+			schedule.probe = time.Duration(probeMinutes) * time.Minute
+			schedule.ProbeInterval = schedule.probe.String()
+			if nextProbe.Valid {
+				schedule.NextRun = nextProbe.Time
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		B.LogErr(err)
+	}
+}
+
+// quarantineRow is the failure state of a site as site_quarantine stores it, cleared deletes the row
+type quarantineRow struct {
+	url           string
+	failures      int
+	quarantinedAt sql.NullTime
+	probeMinutes  int
+	nextProbe     sql.NullTime
+	lastError     string
+	cleared       bool
+}
+
+// recordOutcome counts consecutive failures and quarantines a site after too many, a success releases it. Callers
+// hold mu and save the returned row with saveQuarantine once they have let go of it, ok is false when nothing changed.
+func (s *Scheduler) recordOutcome(schedule *SiteSchedule, result CrawlResult, now time.Time) (row quarantineRow, ok bool) {
+	if result.Err == nil {
+		if schedule.ConsecutiveFailures == 0 {
+			return row, false
+		}
+
+		if schedule.Quarantined {
+			B.LogOut("Released from quarantine after a successful probe: " + schedule.Url)
+		}
+
+		return s.clearQuarantine(schedule), true
+	}
+
+	schedule.ConsecutiveFailures++
+
+	switch {
+	case schedule.Quarantined:
+		schedule.probe = min(schedule.probe*2, maxQuarantineProbe)
+	case schedule.ConsecutiveFailures >= s.quarantineAfter:
+		schedule.Quarantined = true
+		schedule.QuarantinedAt = now
+		schedule.probe = s.quarantineProbe
+		B.LogOut("Quarantined after " + strconv.Itoa(schedule.ConsecutiveFailures) + " consecutive failures: " + schedule.Url)
+	}
+
+	row = quarantineRow{
+		url:          schedule.Url,
+		failures:     schedule.ConsecutiveFailures,
+		probeMinutes: int(schedule.probe / time.Minute),
+		lastError:    result.Error,
+	}
+	if schedule.Quarantined {
+		schedule.NextRun = now.Add(schedule.probe)
+		schedule.ProbeInterval = schedule.probe.String()
+		row.quarantinedAt = sql.NullTime{Time: schedule.QuarantinedAt, Valid: true}
+		row.nextProbe = sql.NullTime{Time: schedule.NextRun, Valid: true}
+	}
+
+	return row, true
+}
+
+// clearQuarantine resets the failure state in memory, callers hold mu and save the returned row after it
+func (s *Scheduler) clearQuarantine(schedule *SiteSchedule) quarantineRow {
+	schedule.ConsecutiveFailures = 0
+	schedule.Quarantined = false
+	schedule.QuarantinedAt = time.Time{}
+	schedule.probe = 0
+	schedule.ProbeInterval = ""
+
+	return quarantineRow{url: schedule.Url, cleared: true}
+}
+
+// saveQuarantine persists a row from recordOutcome or clearQuarantine, outside mu so the database never holds up
+// the handlers reading the schedules
+func (s *Scheduler) saveQuarantine(row quarantineRow) {
+	var err error
+	if row.cleared {
+		_, err = s.db.Exec("DELETE FROM site_quarantine WHERE url = $1", row.url)
+	} else {
+		_, err = s.db.Exec(`INSERT INTO site_quarantine (url, failures, quarantined_at, probe_minutes, next_probe, last_error, updated)
+			VALUES ($1, $2, $3, $4, $5, $6, NOW())
+			ON CONFLICT (url) DO UPDATE SET failures = $2, quarantined_at = $3, probe_minutes = $4, next_probe = $5, last_error = $6, updated = NOW()`,
+			row.url, row.failures, row.quarantinedAt, row.probeMinutes, row.nextProbe, row.lastError)
+	}
+
+	if err != nil {
+		B.LogErr(err)
+	}
+}
+
+// Quarantines lists the sites that are failing, quarantined or not
+func (s *Scheduler) Quarantines() []Quarantine {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	quarantines := []Quarantine{}
+	for _, schedule := range s.schedules {
+		if schedule.ConsecutiveFailures == 0 {
+			continue
+		}
+
+		q := Quarantine{
+			Url:                 schedule.Url,
+			Title:               schedule.Title,
+			ConsecutiveFailures: schedule.ConsecutiveFailures,
+			Quarantined:         schedule.Quarantined,
+			LastError:           schedule.LastError,
+		}
+
+		if schedule.Quarantined {
+			quarantinedAt, nextProbe := schedule.QuarantinedAt, schedule.NextRun
+			q.QuarantinedAt = &quarantinedAt
+			q.NextProbe = &nextProbe
+			q.ProbeInterval = schedule.ProbeInterval
+		}
+
+		quarantines = append(quarantines, q)
+	}
+
+	sort.Slice(quarantines, func(i, j int) bool {
+		return quarantines[i].ConsecutiveFailures > quarantines[j].ConsecutiveFailures
+	})
+
+	return quarantines
+}
+
+// Release clears the failure state of a site and crawls it right away
+func (s *Scheduler) Release(url string) bool {
+	var row quarantineRow
+
+	s.mu.Lock()
+	schedule, ok := s.schedules[url]
+	if ok {
+		row = s.clearQuarantine(schedule)
+		schedule.NextRun = time.Now()
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.saveQuarantine(row)
+		B.LogOut("Released from quarantine: " + url)
+		s.wake()
+	}
+
+	return ok
+}
+
+func QuarantineHandler(scheduler *Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isAdmin(req) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			responseJson, _ := json.Marshal(scheduler.Quarantines())
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
+
+		case http.MethodPost:
+			url := strings.TrimSpace(req.URL.Query().Get("url"))
+			if url == "" {
+				http.Error(w, "Missing url", http.StatusBadRequest)
+				return
+			}
+
+			if !scheduler.Release(url) {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+
+			responseJson, _ := json.Marshal(map[string]string{"url": url, "status": "Released"})
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// api/replay.go
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	B "github.com/janevala/home_be/build"
+)
+
+// Largest response body a recording keeps
+const maxFixtureBytes = 20 << 20
+
+// fixture is the metadata of a recorded response, the body sits next to it in a .body file
+type fixture struct {
+	Method string      `json:"method"`
+	Url    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+}
+
+// fixtureTransport records every response to dir, or with replay serves them from dir and never touches the network.
+// A response that was not recorded replays as 404, so a missing robots.txt allows everything like it does live.
+type fixtureTransport struct {
+	base   http.RoundTripper
+	dir    string
+	replay bool
+}
+
+// fixturePath names the files of a request: <dir>/<host>/<hash of method and url>
+func fixturePath(dir string, req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Method + " " + req.URL.String()))
+
+	host := strings.NewReplacer(":", "_", "/", "_").Replace(req.URL.Host)
+	if host == "" {
+		host = "_"
+	}
+
+	return filepath.Join(dir, host, hex.EncodeToString(sum[:8]))
+}
+
+func (t *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := fixturePath(t.dir, req)
+	if t.replay {
+		return replayFixture(req, path)
+	}
+
+	// Validators from the live cache would record an empty 304
+	req = req.Clone(req.Context())
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFixtureBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	// A cut body would replay as a different response, it is passed on whole and replays as missing instead
+	if len(body) > maxFixtureBytes {
+		B.LogOut("Not recorded, body larger than " + strconv.Itoa(maxFixtureBytes) + " bytes: " + req.URL.String())
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := writeFixture(path, fixture{Method: req.Method, Url: req.URL.String(), Status: resp.StatusCode, Header: resp.Header}, body); err != nil {
+		B.LogErr(err)
+	}
+
+	return resp, nil
+}
+
+func writeFixture(path string, f fixture, body []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	meta, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".body", body, 0o644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path+".json", meta, 0o644)
+}
+
+func replayFixture(req *http.Request, path string) (*http.Response, error) {
+	meta, err := os.ReadFile(path + ".json")
+	if errors.Is(err, fs.ErrNotExist) {
+		B.LogOut("No fixture for: " + req.URL.String())
+		return fixtureResponse(req, http.StatusNotFound, http.Header{}, nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f fixture
+	if err := json.Unmarshal(meta, &f); err != nil {
+		return nil, fmt.Errorf("fixture %s: %w", path, err)
+	}
+
+	body, err := os.ReadFile(path + ".body")
+	if err != nil {
+		return nil, err
+	}
+
+	return fixtureResponse(req, f.Status, f.Header, body), nil
+}
+
+func fixtureResponse(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// fileTransport serves file:// site urls, file://feeds/a.xml is relative to the working directory
+type fileTransport struct{}
+
+// fileClient reads the feeds of file:// sites. Only config.json can set one, so only the feed fetch of a site uses it,
+// links found in feeds and pages go through crawlClient which refuses file urls.
+var fileClient = &http.Client{Transport: fileTransport{}}
+
+func (fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "file" {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedScheme, req.URL.Scheme)
+	}
+
+	path := filepath.FromSlash(req.URL.Path)
+	if host := req.URL.Host; host != "" && host != "localhost" {
+		path = filepath.Join(host, path)
+	}
+
+	body, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fixtureResponse(req, http.StatusNotFound, nil, nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	return fixtureResponse(req, http.StatusOK, header, body), nil
+}
+
+// crawlTransport is the network below politeness: http.DefaultTransport or the fixtures of a recording or replay run
+func crawlTransport(record string, replay string) http.RoundTripper {
+	network := http.DefaultTransport.(*http.Transport).Clone()
+
+	switch {
+	case replay != "":
+		B.LogOut("Crawler replaying fixtures from: " + replay)
+		return &fixtureTransport{base: network, dir: replay, replay: true}
+	case record != "":
+		B.LogOut("Crawler recording fixtures to: " + record)
+		return &fixtureTransport{base: network, dir: record}
+	}
+
+	return network
+}
@@ -0,0 +1,122 @@
+// api/replay_test.go
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	Conf "github.com/janevala/home_be/config"
+)
+
+func TestFixtureRecordReplay(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), maxFixtureBytes+1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/feed.xml":
+			if req.Header.Get("If-None-Match") != "" {
+				t.Error("validators reached the server while recording")
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("<rss/>"))
+		case "/large.xml":
+			w.Write(large)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	recording := &http.Client{Transport: crawlTransport(dir, "")}
+	replaying := &http.Client{Transport: crawlTransport("", dir)}
+
+	get := func(client *http.Client, path string, etag string) (int, string, []byte) {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.StatusCode, resp.Header.Get("ETag"), body
+	}
+
+	if status, etag, body := get(recording, "/feed.xml", `"v0"`); status != http.StatusOK || etag != `"v1"` || string(body) != "<rss/>" {
+		t.Fatalf("recorded %d %s %q", status, etag, body)
+	}
+	if status, etag, body := get(replaying, "/feed.xml", ""); status != http.StatusOK || etag != `"v1"` || string(body) != "<rss/>" {
+		t.Errorf("replayed %d %s %q, want the recorded response", status, etag, body)
+	}
+
+	// Too large to record: the live response is passed on whole and nothing replays
+	if status, _, body := get(recording, "/large.xml", ""); status != http.StatusOK || len(body) != len(large) {
+		t.Errorf("recorded large body %d of %d bytes", len(body), len(large))
+	}
+	if status, _, _ := get(replaying, "/large.xml", ""); status != http.StatusNotFound {
+		t.Errorf("replayed large body with status %d, want 404", status)
+	}
+
+	if status, _, _ := get(replaying, "/never.xml", ""); status != http.StatusNotFound {
+		t.Errorf("replayed an unrecorded url with status %d, want 404", status)
+	}
+}
+
+func TestFileUrls(t *testing.T) {
+	politeTesting(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "feed.xml")
+	if err := os.WriteFile(path, []byte("<rss/>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fileUrl := "file://" + filepath.ToSlash(path)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/robots.txt" {
+			http.NotFound(w, req)
+			return
+		}
+		http.Redirect(w, req, fileUrl, http.StatusFound)
+	}))
+	defer server.Close()
+
+	// Links from feeds and pages never read local files, directly or through a redirect
+	for _, link := range []string{fileUrl, server.URL + "/moved"} {
+		if _, err := fetchPage(t.Context(), link); !errors.Is(err, errUnsupportedScheme) {
+			t.Errorf("fetchPage(%s) error = %v, want %v", link, err, errUnsupportedScheme)
+		}
+	}
+
+	// The feed of a file:// site from config.json is read from disk
+	db, mock := newMockDb(t)
+	expectFeedCache(mock, nil)
+
+	fetched, err := fetchConditional(t.Context(), db, Conf.Site{Title: "Local", Url: fileUrl, Type: "rss"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fetched.body) != "<rss/>" {
+		t.Errorf("file feed body = %q, want %q", fetched.body, "<rss/>")
+	}
+}
@@ -0,0 +1,227 @@
+// api/revisions.go
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+)
+
+// RevisionChange is one field a publisher edited, with the text before and after
+type RevisionChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+type Revision struct {
+	RevisedAt time.Time        `json:"revisedAt"`
+	Changes   []RevisionChange `json:"changes"`
+}
+
+type ArticleRevisions struct {
+	Id        int        `json:"id"`
+	Title     string     `json:"title"`
+	Link      string     `json:"link"`
+	Revisions []Revision `json:"revisions"`
+}
+
+func migrateRevisions(db *sql.DB) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS feed_item_revisions (
+			id SERIAL PRIMARY KEY,
+			item_id INT NOT NULL REFERENCES feed_items(id) ON DELETE CASCADE,
+			old_title TEXT NOT NULL,
+			new_title TEXT NOT NULL,
+			old_description TEXT NOT NULL,
+			new_description TEXT NOT NULL,
+			old_link TEXT NOT NULL,
+			new_link TEXT NOT NULL,
+			revised_at timestamptz NOT NULL DEFAULT NOW()
+		)`,
+		"CREATE INDEX IF NOT EXISTS feed_item_revisions_item_idx ON feed_item_revisions (item_id, revised_at)",
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reviseItem looks the item up by identity, or by canonical link for rows stored before items had a GUID.
+// A known item whose title, description or link changed is updated in place and the old version kept as a revision.
+func reviseItem(db *sql.DB, item *NewsItem) (known bool, revised bool) {
+	id, title, description, link, err := findKnownItem(db, item)
+	if err == sql.ErrNoRows {
+		return false, false
+	}
+	if err != nil {
+		B.LogErr(err)
+		return false, false
+	}
+
+	// A field the feed left out this time is not an edit
+	newTitle, newDescription, newLink := title, description, link
+	if item.Title != "" {
+		newTitle = item.Title
+	}
+	if item.Description != "" {
+		newDescription = item.Description
+	}
+	if item.Link != "" {
+		newLink = item.Link
+	}
+
+	if newTitle == title && newDescription == description && newLink == link {
+		return true, false
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		B.LogErr(err)
+		return true, false
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO feed_item_revisions (item_id, old_title, new_title, old_description, new_description, old_link, new_link)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, id, title, newTitle, description, newDescription, link, newLink)
+	if err != nil {
+		B.LogErr(err)
+		return true, false
+	}
+
+	descriptionHtml := item.DescriptionHtml
+	if newDescription == description {
+		descriptionHtml = ""
+	}
+
+	// Extracted content belongs to the old link and is extracted again on the next request
+	_, err = tx.Exec(`UPDATE feed_items SET title = $1, description = $2, description_html = COALESCE(NULLIF($3, ''), description_html),
+		link = $4, canonical_link = $5, simhash = $6,
+		extracted_at = CASE WHEN link = $4 THEN extracted_at ELSE NULL END
+		WHERE id = $7`,
+		newTitle, newDescription, descriptionHtml, newLink, canonicalizeLink(newLink), int64(simhash(newTitle+" "+newDescription)), id)
+	if err != nil {
+		B.LogErr(err)
+		return true, false
+	}
+
+	if err := tx.Commit(); err != nil {
+		B.LogErr(err)
+		return true, false
+	}
+
+	B.LogOut("Revised item (pk: " + strconv.Itoa(id) + "): " + ellipticalTruncate(newTitle, 35))
+	return true, true
+}
+
+// findKnownItem matches by identity first, then by canonical link within the source for rows stored before items had a GUID.
+// Items with different GUIDs that share a link, like live blog entries, stay apart. A legacy row matched by link takes
+// the GUID of the item so the next item with that link does not match it as well.
+func findKnownItem(db *sql.DB, item *NewsItem) (id int, title string, description string, link string, err error) {
+	var byIdentity bool
+	err = db.QueryRow(`SELECT id, title, description, link, uuid = $1 FROM feed_items
+		WHERE uuid = $1 OR ($3 <> '' AND guid = '' AND source = $2 AND canonical_link = $3)
+		ORDER BY (uuid = $1) DESC, id
+		LIMIT 1`, item.Uuid, item.Source, item.CanonicalLink).Scan(&id, &title, &description, &link, &byIdentity)
+	if err != nil || byIdentity || item.Guid == "" {
+		return id, title, description, link, err
+	}
+
+	if _, err := db.Exec("UPDATE feed_items SET uuid = $2, guid = $3 WHERE id = $1", id, item.Uuid, item.Guid); err != nil {
+		B.LogErr(err)
+	}
+
+	return id, title, description, link, nil
+}
+
+// revisionChanges lists the fields that differ between the old and new version
+func revisionChanges(oldTitle, newTitle, oldDescription, newDescription, oldLink, newLink string) []RevisionChange {
+	changes := []RevisionChange{}
+	for _, field := range []RevisionChange{
+		{Field: "title", Old: oldTitle, New: newTitle},
+		{Field: "description", Old: oldDescription, New: newDescription},
+		{Field: "link", Old: oldLink, New: newLink},
+	} {
+		if field.Old != field.New {
+			changes = append(changes, field)
+		}
+	}
+
+	return changes
+}
+
+func ArticleRevisionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			if !strings.Contains(req.URL.RawQuery, "code=123") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid"))
+				return
+			}
+
+			id := 0
+			if i := req.URL.Query().Get("id"); i != "" {
+				if i, err := strconv.Atoi(i); err == nil && i > 0 {
+					id = i
+				}
+			}
+
+			var article ArticleRevisions
+			err := db.QueryRow("SELECT id, title, link FROM feed_items WHERE id = $1", id).Scan(&article.Id, &article.Title, &article.Link)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Article not found", http.StatusNotFound)
+				return
+			}
+
+			if err != nil {
+				B.LogErr(err)
+				http.Error(w, "Database query error", http.StatusInternalServerError)
+				return
+			}
+
+			rows, err := db.Query(`SELECT old_title, new_title, old_description, new_description, old_link, new_link, revised_at
+				FROM feed_item_revisions
+				WHERE item_id = $1
+				ORDER BY revised_at, id`, id)
+			if err != nil {
+				B.LogErr(err)
+				http.Error(w, "Database query error", http.StatusInternalServerError)
+				return
+			}
+
+			defer rows.Close()
+
+			article.Revisions = []Revision{}
+			for rows.Next() {
+				var oldTitle, newTitle, oldDescription, newDescription, oldLink, newLink string
+				var revision Revision
+				err := rows.Scan(&oldTitle, &newTitle, &oldDescription, &newDescription, &oldLink, &newLink, &revision.RevisedAt)
+				if err != nil {
+					B.LogErr(err)
+					http.Error(w, "Database scan error", http.StatusInternalServerError)
+					return
+				}
+
+				revision.Changes = revisionChanges(oldTitle, newTitle, oldDescription, newDescription, oldLink, newLink)
+				article.Revisions = append(article.Revisions, revision)
+			}
+
+			responseJson, _ := json.Marshal(article)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// api/revisions_test.go
+package api
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFindKnownItem(t *testing.T) {
+	tests := []struct {
+		name string
+		guid string
+		// How the row was found: "identity", "link" or "" for none
+		match     string
+		wantClaim bool
+		wantErr   error
+	}{
+		{name: "same identity", guid: "entry-1", match: "identity"},
+		{name: "legacy row by link takes the guid", guid: "entry-1", match: "link", wantClaim: true},
+		{name: "legacy row by link without a guid", match: "link"},
+		{name: "unknown", guid: "entry-1", wantErr: sql.ErrNoRows},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDb(t)
+
+			item := &NewsItem{Source: "Example", Guid: tt.guid, Uuid: "uuid-1", CanonicalLink: "https://example.com/live"}
+
+			// Only rows without a GUID match by link, items that have different GUIDs stay apart
+			query := mock.ExpectQuery(`uuid = \$1 OR \(\$3 <> '' AND guid = '' AND source = \$2 AND canonical_link = \$3\)`).
+				WithArgs(item.Uuid, item.Source, item.CanonicalLink)
+			if tt.match == "" {
+				query.WillReturnError(sql.ErrNoRows)
+			} else {
+				query.WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "link", "identity"}).
+					AddRow(7, "Live", "", "https://example.com/live", tt.match == "identity"))
+			}
+			if tt.wantClaim {
+				mock.ExpectExec("UPDATE feed_items SET uuid = \\$2, guid = \\$3").
+					WithArgs(7, item.Uuid, item.Guid).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			id, _, _, _, err := findKnownItem(db, item)
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && id != 7 {
+				t.Errorf("id = %d, want 7", id)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
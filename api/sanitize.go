@@ -0,0 +1,250 @@
+// api/sanitize.go
+package api
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+	"unicode"
+
+	B "github.com/janevala/home_be/build"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Tags allowed in sanitized descriptions, all attributes are dropped except href on links
+var safeTags = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.Br:         true,
+	atom.A:          true,
+	atom.B:          true,
+	atom.Strong:     true,
+	atom.I:          true,
+	atom.Em:         true,
+	atom.U:          true,
+	atom.Ul:         true,
+	atom.Ol:         true,
+	atom.Li:         true,
+	atom.Blockquote: true,
+	atom.Code:       true,
+	atom.Pre:        true,
+}
+
+// Tags whose content is dropped together with the tag
+var droppedTags = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Iframe:   true,
+	atom.Noscript: true,
+	atom.Object:   true,
+	atom.Embed:    true,
+	atom.Svg:      true,
+	atom.Template: true,
+}
+
+// sanitizeHtml keeps allowlisted tags, closes what was left open and truncates the visible text to maxLen runes
+func sanitizeHtml(document string, maxLen int) string {
+	var out strings.Builder
+	var open []atom.Atom
+	dropDepth := 0
+	remaining := maxLen
+
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	for remaining > 0 {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedTags[token.DataAtom] {
+				if tokenType == html.StartTagToken {
+					dropDepth++
+				}
+				continue
+			}
+			if dropDepth > 0 || !safeTags[token.DataAtom] {
+				continue
+			}
+
+			out.WriteString("<" + token.Data)
+			if token.DataAtom == atom.A {
+				if href := safeHref(token); href != "" {
+					out.WriteString(` href="` + html.EscapeString(href) + `" rel="nofollow noopener"`)
+				}
+			}
+			out.WriteString(">")
+
+			if token.DataAtom != atom.Br && tokenType == html.StartTagToken {
+				open = append(open, token.DataAtom)
+			}
+		case html.EndTagToken:
+			if droppedTags[token.DataAtom] {
+				if dropDepth > 0 {
+					dropDepth--
+				}
+				continue
+			}
+			if dropDepth > 0 {
+				continue
+			}
+
+			// Only close tags that are open, closing any left open inside them
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == token.DataAtom {
+					for j := len(open) - 1; j >= i; j-- {
+						out.WriteString("</" + open[j].String() + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+		case html.TextToken:
+			if dropDepth > 0 {
+				continue
+			}
+
+			text := collapseSpaces(token.Data)
+			if stringLength(text) > remaining {
+				text = ellipticalTruncate(text, remaining)
+				remaining = 0
+			} else {
+				remaining -= stringLength(text)
+			}
+
+			out.WriteString(html.EscapeString(text))
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i].String() + ">")
+	}
+
+	return strings.TrimSpace(out.String())
+}
+
+func safeHref(token html.Token) string {
+	for _, a := range token.Attr {
+		if a.Key != "href" {
+			continue
+		}
+
+		u, err := url.Parse(strings.TrimSpace(a.Val))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return ""
+		}
+
+		return u.String()
+	}
+
+	return ""
+}
+
+// plainText strips all markup, decodes entities and collapses whitespace
+func plainText(document string) string {
+	var out strings.Builder
+	dropDepth := 0
+
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			break
+		}
+
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.StartTagToken:
+			if droppedTags[token.DataAtom] {
+				dropDepth++
+			} else if blockTags[token.DataAtom] {
+				out.WriteString(" ")
+			}
+		case html.SelfClosingTagToken:
+			if blockTags[token.DataAtom] {
+				out.WriteString(" ")
+			}
+		case html.EndTagToken:
+			if droppedTags[token.DataAtom] && dropDepth > 0 {
+				dropDepth--
+			} else if blockTags[token.DataAtom] {
+				out.WriteString(" ")
+			}
+		case html.TextToken:
+			if dropDepth == 0 {
+				out.WriteString(token.Data)
+			}
+		}
+	}
+
+	return strings.TrimSpace(collapseSpaces(out.String()))
+}
+
+func collapseSpaces(text string) string {
+	var sb strings.Builder
+	space := false
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if space && sb.Len() > 0 {
+			sb.WriteRune(' ')
+		}
+		space = false
+		sb.WriteRune(r)
+	}
+
+	if space && sb.Len() > 0 {
+		sb.WriteRune(' ')
+	}
+
+	return sb.String()
+}
+
+// migrateDescriptions adds description_html and cleans descriptions stored before sanitizing existed
+func migrateDescriptions(db *sql.DB) error {
+	_, err := db.Exec("ALTER TABLE feed_items ADD COLUMN IF NOT EXISTS description_html TEXT")
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT id, title, description FROM feed_items WHERE description_html IS NULL")
+	if err != nil {
+		return err
+	}
+
+	type storedDescription struct {
+		id          int
+		title       string
+		description string
+	}
+
+	var stored []storedDescription
+	for rows.Next() {
+		var item storedDescription
+		if err := rows.Scan(&item.id, &item.title, &item.description); err != nil {
+			rows.Close()
+			return err
+		}
+
+		stored = append(stored, item)
+	}
+
+	rows.Close()
+
+	for _, item := range stored {
+		_, err := db.Exec("UPDATE feed_items SET title = $1, description = $2, description_html = $3 WHERE id = $4",
+			plainText(item.title),
+			ellipticalTruncate(plainText(item.description), maxDescriptionLength),
+			sanitizeHtml(item.description, maxDescriptionLength),
+			item.id)
+		if err != nil {
+			B.LogErr(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,468 @@
+// api/scheduler.go
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+)
+
+const defaultCrawlInterval = 120 * time.Minute
+
+type SiteSchedule struct {
+	Title     string    `json:"title"`
+	Url       string    `json:"url"`
+	Interval  string    `json:"interval"`
+	LastRun   time.Time `json:"lastRun"`
+	NextRun   time.Time `json:"nextRun"`
+	LastError string    `json:"lastError,omitempty"`
+	Runs      int       `json:"runs"`
+	Failures  int       `json:"failures"`
+
+	LastResult *CrawlResult `json:"lastResult,omitempty"`
+
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	Quarantined         bool      `json:"quarantined,omitempty"`
+	QuarantinedAt       time.Time `json:"-"`
+	ProbeInterval       string    `json:"probeInterval,omitempty"`
+
+	// Items arrive through WebSub, polling falls back to webSubPollInterval
+	Pushed bool `json:"pushed,omitempty"`
+
+	// Learned interval of a site without its own, from the posting cadence and the feed hint
+	Adaptive bool   `json:"adaptive,omitempty"`
+	Cadence  string `json:"cadence,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+
+	every   time.Duration
+	probe   time.Duration
+	fixed   bool
+	adapted time.Duration
+	cadence time.Duration
+	hint    time.Duration
+}
+
+// CrawlStats are totals over all crawls since startup
+type CrawlStats struct {
+	Crawls       int   `json:"crawls"`
+	Fetches      int   `json:"fetches"`
+	Failures     int   `json:"failures"`
+	NotModified  int   `json:"notModified"`
+	Disallowed   int64 `json:"disallowed"`
+	Inserted     int   `json:"inserted"`
+	Revised      int   `json:"revised"`
+	BytesFetched int64 `json:"bytesFetched"`
+	BytesSaved   int64 `json:"bytesSaved"`
+}
+
+type SchedulerStatus struct {
+	Stats CrawlStats     `json:"stats"`
+	Sites []SiteSchedule `json:"sites"`
+}
+
+// Scheduler crawls every site on its own interval until the context given to Run is cancelled
+type Scheduler struct {
+	db       *sql.DB
+	sites    *SiteStore
+	webSub   *WebSub
+	crawler  Conf.CrawlerConfig
+	interval time.Duration
+
+	adaptive    bool
+	minInterval time.Duration
+	maxInterval time.Duration
+
+	quarantineAfter int
+	quarantineProbe time.Duration
+
+	mu        sync.RWMutex
+	schedules map[string]*SiteSchedule
+	stats     CrawlStats
+
+	trigger chan struct{}
+	wakeup  chan struct{}
+	done    chan struct{}
+}
+
+func NewScheduler(sites *SiteStore, webSub *WebSub, crawler Conf.CrawlerConfig, db *sql.DB) *Scheduler {
+	configurePoliteness(crawler)
+
+	interval := time.Duration(crawler.Interval) * time.Minute
+	if interval <= 0 {
+		interval = defaultCrawlInterval
+	}
+
+	s := &Scheduler{
+		db:              db,
+		sites:           sites,
+		webSub:          webSub,
+		crawler:         crawler,
+		interval:        interval,
+		adaptive:        crawler.AdaptiveInterval,
+		minInterval:     defaultMinInterval,
+		maxInterval:     defaultMaxInterval,
+		quarantineAfter: defaultQuarantineAfter,
+		quarantineProbe: defaultQuarantineProbe,
+		schedules:       make(map[string]*SiteSchedule),
+		trigger:         make(chan struct{}, 1),
+		wakeup:          make(chan struct{}, 1),
+		done:            make(chan struct{}),
+	}
+
+	if crawler.MinInterval > 0 {
+		s.minInterval = time.Duration(crawler.MinInterval) * time.Minute
+	}
+	if crawler.MaxInterval > 0 {
+		s.maxInterval = time.Duration(crawler.MaxInterval) * time.Minute
+	}
+	s.maxInterval = max(s.maxInterval, s.minInterval)
+
+	if crawler.QuarantineAfter > 0 {
+		s.quarantineAfter = crawler.QuarantineAfter
+	}
+	if crawler.QuarantineProbe > 0 {
+		s.quarantineProbe = time.Duration(crawler.QuarantineProbe) * time.Minute
+	}
+
+	s.syncSchedules(sites.Sites().Sites, time.Now())
+	s.loadQuarantine()
+
+	return s
+}
+
+// syncSchedules makes new sites due right away and forgets the ones that were removed, callers hold mu
+func (s *Scheduler) syncSchedules(sites []Conf.Site, now time.Time) {
+	live := make(map[string]bool)
+	for _, site := range sites {
+		live[site.Url] = true
+
+		schedule, ok := s.schedules[site.Url]
+
+		every := s.interval
+		if site.Interval > 0 {
+			every = time.Duration(site.Interval) * time.Minute
+		} else if ok && s.adaptive && schedule.adapted > 0 {
+			every = schedule.adapted
+		}
+
+		if !ok {
+			schedule = &SiteSchedule{Url: site.Url, NextRun: now}
+			s.schedules[site.Url] = schedule
+		} else if every < schedule.every && !schedule.Quarantined && !schedule.LastRun.IsZero() && schedule.LastRun.Add(every).Before(schedule.NextRun) {
+			// A shortened interval applies now rather than after the old one has passed
+			schedule.NextRun = schedule.LastRun.Add(every)
+		}
+
+		schedule.Title = site.Title
+		schedule.fixed = site.Interval > 0
+		schedule.Adaptive = s.adaptive && !schedule.fixed
+		schedule.every = every
+		schedule.Interval = every.String()
+	}
+
+	for url := range s.schedules {
+		if !live[url] {
+			delete(s.schedules, url)
+		}
+	}
+}
+
+// Run blocks until ctx is cancelled and the crawl in progress, if any, has returned
+func (s *Scheduler) Run(ctx context.Context) {
+	defer close(s.done)
+
+	B.LogOut("Scheduler started with interval " + s.interval.String())
+	if s.adaptive {
+		B.LogOut("Adaptive intervals between " + s.minInterval.String() + " and " + s.maxInterval.String())
+	}
+
+	for {
+		s.runDue(ctx)
+
+		timer := time.NewTimer(time.Until(s.nextRun()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			B.LogOut("Scheduler stopped")
+			return
+		case <-s.trigger:
+			timer.Stop()
+			s.markAllDue()
+		case <-s.sites.Changed():
+			timer.Stop()
+		case <-s.wakeup:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Done is closed once Run has returned
+func (s *Scheduler) Done() <-chan struct{} {
+	return s.done
+}
+
+// wake makes Run look at the schedules again, it never blocks
+func (s *Scheduler) wake() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Trigger asks the scheduler to crawl every site now except the quarantined ones and, with adaptive intervals,
+// the ones crawled more recently than the minimum interval or their feed hint allow. It never blocks.
+func (s *Scheduler) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) Status() SchedulerStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sites := make([]SiteSchedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		sites = append(sites, *schedule)
+	}
+
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].NextRun.Before(sites[j].NextRun)
+	})
+
+	stats := s.stats
+	stats.Disallowed = politeness.Disallowed()
+
+	return SchedulerStatus{Stats: stats, Sites: sites}
+}
+
+// Stats include requests refused by robots.txt, counted for feeds, pages and discovery alike
+func (s *Scheduler) Stats() CrawlStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := s.stats
+	stats.Disallowed = politeness.Disallowed()
+
+	return stats
+}
+
+func (s *Scheduler) nextRun() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	next := time.Now().Add(s.interval)
+	for _, schedule := range s.schedules {
+		if schedule.NextRun.Before(next) {
+			next = schedule.NextRun
+		}
+	}
+
+	return next
+}
+
+func (s *Scheduler) markAllDue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, schedule := range s.schedules {
+		if schedule.Quarantined {
+			continue
+		}
+		if schedule.Adaptive && now.Sub(schedule.LastRun) < max(s.minInterval, schedule.hint) {
+			continue
+		}
+
+		schedule.NextRun = now
+	}
+}
+
+func (s *Scheduler) dueSites(now time.Time) []Conf.Site {
+	sites := s.sites.Sites().Sites
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncSchedules(sites, now)
+
+	var due []Conf.Site
+	for _, site := range sites {
+		if schedule, ok := s.schedules[site.Url]; ok && !schedule.NextRun.After(now) {
+			due = append(due, site)
+		}
+	}
+
+	return due
+}
+
+func (s *Scheduler) runDue(ctx context.Context) {
+	due := s.dueSites(time.Now())
+	if len(due) == 0 || ctx.Err() != nil {
+		return
+	}
+
+	results := s.crawlSafely(ctx, due)
+	s.webSub.Discover(ctx, results)
+	cadences := s.postingCadences(results)
+
+	var rows []quarantineRow
+
+	s.mu.Lock()
+
+	s.stats.Crawls++
+
+	now := time.Now()
+	for i := range results {
+		result := results[i]
+
+		// A fetch cut off by shutdown says nothing about the site, it stays due for the next start
+		if interrupted(ctx, result) {
+			continue
+		}
+
+		s.stats.Fetches++
+		s.stats.Inserted += result.Inserted
+		s.stats.Revised += result.Revised
+		s.stats.BytesFetched += result.Bytes
+		s.stats.BytesSaved += result.BytesSaved
+		if result.NotModified {
+			s.stats.NotModified++
+		}
+		if result.Err != nil {
+			s.stats.Failures++
+		}
+
+		// The site may have been removed while it was crawled
+		schedule, ok := s.schedules[result.Url]
+		if !ok {
+			continue
+		}
+
+		schedule.Runs++
+		schedule.LastRun = now
+		if schedule.Adaptive {
+			s.adapt(schedule, result, cadences)
+		}
+		schedule.NextRun = now.Add(schedule.every)
+		schedule.Pushed = s.webSub.Active(result.Url)
+		if schedule.Pushed {
+			schedule.NextRun = now.Add(max(schedule.every, webSubPollInterval))
+		}
+		schedule.LastError = ""
+		schedule.LastResult = &result
+
+		if result.Err != nil {
+			schedule.Failures++
+			schedule.LastError = result.Error
+		}
+
+		if row, ok := s.recordOutcome(schedule, result, now); ok {
+			rows = append(rows, row)
+		}
+	}
+
+	s.mu.Unlock()
+
+	for _, row := range rows {
+		s.saveQuarantine(row)
+	}
+}
+
+// interrupted tells whether the fetch failed because the crawl was cancelled rather than because of the site
+func interrupted(ctx context.Context, result CrawlResult) bool {
+	return result.Err != nil && (ctx.Err() != nil || errors.Is(result.Err, context.Canceled))
+}
+
+// postingCadences learns the cadence of the crawled sites, outside mu as it reads feed_items
+func (s *Scheduler) postingCadences(results []CrawlResult) map[string]time.Duration {
+	cadences := make(map[string]time.Duration)
+	if !s.adaptive {
+		return cadences
+	}
+
+	now := time.Now()
+	for _, result := range results {
+		cadence, err := postingCadence(s.db, result.Title, now)
+		if err != nil {
+			B.LogErr(err)
+			continue
+		}
+
+		cadences[result.Url] = cadence
+	}
+
+	return cadences
+}
+
+// adapt sets the interval of a site from what was learned, a cadence that could not be read keeps the last one.
+// A 304 or a failed fetch has no feed to read a hint from, the last hint stays. Callers hold mu.
+func (s *Scheduler) adapt(schedule *SiteSchedule, result CrawlResult, cadences map[string]time.Duration) {
+	if result.Err == nil && !result.NotModified {
+		schedule.hint = result.UpdateHint
+	}
+	if cadence, ok := cadences[result.Url]; ok {
+		schedule.cadence = cadence
+	}
+
+	schedule.adapted = adaptInterval(schedule.cadence, schedule.hint, s.interval, s.minInterval, s.maxInterval)
+	schedule.every = schedule.adapted
+	schedule.Interval = schedule.every.String()
+
+	schedule.Cadence = ""
+	if schedule.cadence > 0 {
+		schedule.Cadence = schedule.cadence.Round(time.Minute).String()
+	}
+	schedule.Hint = ""
+	if schedule.hint > 0 {
+		schedule.Hint = schedule.hint.String()
+	}
+}
+
+// crawlSafely keeps a panicking crawl from taking the scheduler down, every due site is then marked failed
+func (s *Scheduler) crawlSafely(ctx context.Context, due []Conf.Site) (results []CrawlResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("crawl panic: %v", r)
+			B.LogErr(err)
+
+			results = make([]CrawlResult, len(due))
+			for i, site := range due {
+				results[i] = CrawlResult{Title: site.Title, Url: site.Url, Error: err.Error(), Err: err}
+			}
+		}
+	}()
+
+	return crawl(ctx, Conf.SitesConfig{Title: s.sites.Sites().Title, Sites: due}, s.db, s.crawler)
+}
+
+func SchedulerHandler(scheduler *Scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			if !strings.Contains(req.URL.RawQuery, "code=123") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid"))
+				return
+			}
+
+			responseJson, _ := json.Marshal(scheduler.Status())
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// api/scheduler_test.go
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestInterrupted(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fetchErr := &url.Error{Op: "Get", URL: "https://example.com/feed.xml", Err: context.Canceled}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "success", ctx: context.Background()},
+		{name: "site failure", ctx: context.Background(), err: errors.New("fetch: 500 Internal Server Error")},
+		{name: "site timeout", ctx: context.Background(), err: context.DeadlineExceeded},
+		{name: "cancelled fetch", ctx: context.Background(), err: fetchErr, want: true},
+		{name: "cancelled after retries", ctx: context.Background(), err: fmt.Errorf("after 3 attempts: %w", fetchErr), want: true},
+		{name: "failure during shutdown", ctx: cancelled, err: errors.New("fetch: 500 Internal Server Error"), want: true},
+		{name: "success during shutdown", ctx: cancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := interrupted(tt.ctx, CrawlResult{Err: tt.err}); got != tt.want {
+				t.Errorf("interrupted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+// api/schema.go
+package api
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Schema steps in order, tables before the migrations that alter them
+var schemaSteps = []struct {
+	name string
+	run  func(db *sql.DB) error
+}{
+	{"feed_items", createTableIfNeeded},
+	{"item identity", migrateItemIdentity},
+	{"near duplicates", migrateNearDuplicates},
+	{"article content", migrateArticleContent},
+	{"thumbnails", migrateThumbnails},
+	{"descriptions", migrateDescriptions},
+	{"dates", migrateDates},
+	{"item metadata", migrateItemMetadata},
+	{"revisions", migrateRevisions},
+	{"cadence", migrateCadence},
+	{"feed_cache", createCacheTableIfNeeded},
+	{"feed_fetch_log", createFetchLogTableIfNeeded},
+	{"archive", createArchiveTablesIfNeeded},
+	{"sites", createSitesTableIfNeeded},
+	{"site settings", migrateSiteSettings},
+	{"item category", migrateItemCategory},
+	{"site_quarantine", createQuarantineTableIfNeeded},
+	{"websub_subscriptions", createWebSubTableIfNeeded},
+}
+
+// Migrate creates the tables and brings an older database up to date. It runs once at startup, before the crawler,
+// the handlers or a command touch the database.
+func Migrate(db *sql.DB) error {
+	for _, step := range schemaSteps {
+		if err := step.run(db); err != nil {
+			return fmt.Errorf("schema %s: %w", step.name, err)
+		}
+	}
+
+	return nil
+}
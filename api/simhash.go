@@ -0,0 +1,178 @@
+// api/simhash.go
+package api
+
+import (
+	"database/sql"
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode"
+
+	B "github.com/janevala/home_be/build"
+)
+
+const (
+	// Fingerprints this close are treated as the same story
+	nearDuplicateDistance = 6
+	// Only stories published this close to each other are compared
+	nearDuplicateWindow = 72 * time.Hour
+)
+
+// simhash fingerprints text over words and word pairs, so changing a few words moves only a few bits
+func simhash(text string) uint64 {
+	words := simhashTokens(text)
+	if len(words) == 0 {
+		return 0
+	}
+
+	var weights [64]int
+	addShingle := func(shingle string) {
+		h := fnv.New64a()
+		h.Write([]byte(shingle))
+		sum := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<uint(bit)) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+
+	for i := range words {
+		addShingle(words[i])
+		if i+1 < len(words) {
+			addShingle(words[i] + " " + words[i+1])
+		}
+	}
+
+	var fingerprint uint64
+	for bit := 0; bit < 64; bit++ {
+		if weights[bit] > 0 {
+			fingerprint |= 1 << uint(bit)
+		}
+	}
+
+	return fingerprint
+}
+
+// simhashTokens lowercases words and skips anything inside html tags
+func simhashTokens(text string) []string {
+	var words []string
+	var word strings.Builder
+	inTag := false
+
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+
+	for _, r := range text {
+		switch {
+		case r == '<':
+			flush()
+			inTag = true
+		case r == '>':
+			inTag = false
+		case inTag:
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return words
+}
+
+func hammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// findCanonicalItem returns the id of the closest earlier story from another source, or 0 when there is none
+func findCanonicalItem(db *sql.DB, item *NewsItem) int {
+	if item.Simhash == 0 || item.PublishedParsed == nil {
+		return 0
+	}
+
+	rows, err := db.Query(`SELECT id, simhash FROM feed_items
+		WHERE source <> $1
+		AND canonical_id IS NULL
+		AND simhash IS NOT NULL
+		AND published_parsed BETWEEN $2 AND $3
+		ORDER BY id`,
+		item.Source, item.PublishedParsed.Add(-nearDuplicateWindow), item.PublishedParsed.Add(nearDuplicateWindow))
+
+	if err != nil {
+		B.LogErr(err)
+		return 0
+	}
+
+	defer rows.Close()
+
+	canonicalId := 0
+	bestDistance := nearDuplicateDistance + 1
+	for rows.Next() {
+		var id int
+		var fingerprint int64
+		if err := rows.Scan(&id, &fingerprint); err != nil {
+			B.LogErr(err)
+			return 0
+		}
+
+		if distance := hammingDistance(item.Simhash, uint64(fingerprint)); distance < bestDistance {
+			canonicalId = id
+			bestDistance = distance
+		}
+	}
+
+	return canonicalId
+}
+
+// migrateNearDuplicates adds the fingerprint columns and fingerprints rows stored before them
+func migrateNearDuplicates(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE feed_items
+		ADD COLUMN IF NOT EXISTS simhash BIGINT,
+		ADD COLUMN IF NOT EXISTS canonical_id INTEGER REFERENCES feed_items(id) ON DELETE SET NULL`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS feed_items_canonical_id ON feed_items (canonical_id)")
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT id, title, description FROM feed_items WHERE simhash IS NULL")
+	if err != nil {
+		return err
+	}
+
+	fingerprints := make(map[int]uint64)
+	for rows.Next() {
+		var id int
+		var title string
+		var description string
+		if err := rows.Scan(&id, &title, &description); err != nil {
+			rows.Close()
+			return err
+		}
+
+		fingerprints[id] = simhash(title + " " + description)
+	}
+
+	rows.Close()
+
+	for id, fingerprint := range fingerprints {
+		_, err := db.Exec("UPDATE feed_items SET simhash = $1 WHERE id = $2", int64(fingerprint), id)
+		if err != nil {
+			B.LogErr(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+// api/siterules.go
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+)
+
+// setSiteHeaders applies the User-Agent and extra headers configured for the site
+func setSiteHeaders(req *http.Request, site Conf.Site) {
+	for name, value := range site.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if site.UserAgent != "" {
+		req.Header.Set("User-Agent", site.UserAgent)
+	}
+}
+
+// applySiteRules drops items by the title patterns of the site and keeps the newest MaxItems of the rest
+func applySiteRules(site Conf.Site, items []*NewsItem) []*NewsItem {
+	include := compilePatterns(site.Include)
+	exclude := compilePatterns(site.Exclude)
+
+	kept := []*NewsItem{}
+	for _, item := range items {
+		title := plainText(item.Title)
+
+		if len(include) > 0 && !matchesAny(include, title) {
+			continue
+		}
+		if matchesAny(exclude, title) {
+			continue
+		}
+
+		kept = append(kept, item)
+	}
+
+	if site.MaxItems > 0 && len(kept) > site.MaxItems {
+		// Items without a date count as oldest
+		sort.SliceStable(kept, func(i, j int) bool {
+			if kept[j].PublishedParsed == nil {
+				return kept[i].PublishedParsed != nil
+			}
+			return kept[i].PublishedParsed != nil && kept[i].PublishedParsed.After(*kept[j].PublishedParsed)
+		})
+
+		kept = kept[:site.MaxItems]
+	}
+
+	return kept
+}
+
+// compilePatterns skips what does not compile, LoadConfig and the site API reject such patterns before they get here
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			B.LogErr(err)
+			continue
+		}
+
+		compiled = append(compiled, re)
+	}
+
+	return compiled
+}
+
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// itemLanguage prefers the configured language over the one the feed declares
+func itemLanguage(site Conf.Site, feedLanguage string) string {
+	language := site.Language
+	if language == "" {
+		language = feedLanguage
+	}
+
+	language = strings.ToLower(strings.TrimSpace(language))
+	if len(language) > 10 {
+		language = language[:10]
+	}
+
+	return language
+}
+
+// migrateItemCategory gives items the category of their site, items stored before it existed take the current one
+func migrateItemCategory(db *sql.DB) error {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'feed_items' AND column_name = 'category')`).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		"ALTER TABLE feed_items ADD COLUMN IF NOT EXISTS category VARCHAR(100) NOT NULL DEFAULT ''",
+		"CREATE INDEX IF NOT EXISTS feed_items_category_idx ON feed_items (lower(category))",
+	}
+	if !exists {
+		queries = append(queries, "UPDATE feed_items fi SET category = s.category FROM sites s WHERE fi.source = s.title AND s.category <> ''")
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,682 @@
+// api/sites.go
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+	"github.com/lib/pq"
+)
+
+var (
+	errSiteNotFound = errors.New("site not found")
+	errSiteExists   = errors.New("site url already exists")
+	errTitleExists  = errors.New("site title already exists")
+	errInvalidSite  = errors.New("invalid site")
+)
+
+// ManagedSite is a row of the sites table
+type ManagedSite struct {
+	Id          int               `json:"id"`
+	Title       string            `json:"title"`
+	Url         string            `json:"url"`
+	HtmlUrl     string            `json:"htmlUrl"`
+	Type        string            `json:"type"`
+	Category    string            `json:"category"`
+	Language    string            `json:"language"`
+	Interval    int               `json:"interval"`
+	UserAgent   string            `json:"userAgent"`
+	Headers     map[string]string `json:"headers"`
+	MaxItems    int               `json:"maxItems"`
+	Include     []string          `json:"include"`
+	Exclude     []string          `json:"exclude"`
+	DateLayouts []string          `json:"dateLayouts"`
+	Enabled     bool              `json:"enabled"`
+	Scrape      *SiteScrape       `json:"scrape,omitempty"`
+	Created     time.Time         `json:"created"`
+	Updated     time.Time         `json:"updated"`
+}
+
+// SiteScrape is Conf.Scrape as the api and the sites table spell it
+type SiteScrape struct {
+	Items       string `json:"items"`
+	Title       string `json:"title"`
+	Link        string `json:"link,omitempty"`
+	Date        string `json:"date,omitempty"`
+	Image       string `json:"image,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func (m ManagedSite) site() Conf.Site {
+	enabled := m.Enabled
+
+	return Conf.Site{
+		Title:       m.Title,
+		Url:         m.Url,
+		HtmlUrl:     m.HtmlUrl,
+		Type:        m.Type,
+		Category:    m.Category,
+		Language:    m.Language,
+		Interval:    m.Interval,
+		UserAgent:   m.UserAgent,
+		Headers:     m.Headers,
+		MaxItems:    m.MaxItems,
+		Include:     m.Include,
+		Exclude:     m.Exclude,
+		DateLayouts: m.DateLayouts,
+		Enabled:     &enabled,
+		Scrape:      (*Conf.Scrape)(m.Scrape),
+	}
+}
+
+// SiteUpdate changes only the fields that are set
+type SiteUpdate struct {
+	Title       *string            `json:"title"`
+	Url         *string            `json:"url"`
+	HtmlUrl     *string            `json:"htmlUrl"`
+	Type        *string            `json:"type"`
+	Category    *string            `json:"category"`
+	Language    *string            `json:"language"`
+	Interval    *int               `json:"interval"`
+	UserAgent   *string            `json:"userAgent"`
+	Headers     *map[string]string `json:"headers"`
+	MaxItems    *int               `json:"maxItems"`
+	Include     *[]string          `json:"include"`
+	Exclude     *[]string          `json:"exclude"`
+	DateLayouts *[]string          `json:"dateLayouts"`
+	Enabled     *bool              `json:"enabled"`
+	Scrape      *SiteScrape        `json:"scrape"`
+}
+
+// SiteStore keeps the sites table and a copy of it in memory, the crawler and the handlers read the copy on every use
+type SiteStore struct {
+	db      *sql.DB
+	title   string
+	mu      sync.RWMutex
+	all     []ManagedSite
+	changed chan struct{}
+}
+
+// NewSiteStore seeds an empty sites table from the config, after that the table is the site list
+func NewSiteStore(sites Conf.SitesConfig, db *sql.DB) (*SiteStore, error) {
+	s := &SiteStore{
+		db:      db,
+		title:   sites.Title,
+		changed: make(chan struct{}, 1),
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sites").Scan(&count); err != nil {
+		return nil, err
+	}
+
+	if count == 0 {
+		for _, site := range sites.Sites {
+			if _, err := s.insert(site); err != nil {
+				B.LogErr(err)
+			}
+		}
+
+		B.LogOut("Seeded sites table with " + strconv.Itoa(len(sites.Sites)) + " sites")
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func createSitesTableIfNeeded(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS sites (
+		id SERIAL PRIMARY KEY,
+		title VARCHAR(100) NOT NULL UNIQUE,
+		url VARCHAR(500) NOT NULL UNIQUE,
+		html_url VARCHAR(500) NOT NULL DEFAULT '',
+		type VARCHAR(20) NOT NULL DEFAULT '',
+		category VARCHAR(100) NOT NULL DEFAULT '',
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		created timestamptz DEFAULT NOW(),
+		updated timestamptz DEFAULT NOW()
+	)`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	if err := migrateSiteTitles(db); err != nil {
+		return err
+	}
+
+	return migrateTimestamptz(db, "sites", "created", "updated")
+}
+
+// migrateSiteTitles makes titles unique, feed_items refer to their site by title. Later sites that shared a title
+// get their id appended, the items stored so far stay with the first one.
+func migrateSiteTitles(db *sql.DB) error {
+	res, err := db.Exec(`UPDATE sites SET title = LEFT(title, 90) || ' (' || id || ')', updated = NOW()
+		WHERE id IN (SELECT id FROM (SELECT id, ROW_NUMBER() OVER (PARTITION BY title ORDER BY id) AS n FROM sites) numbered WHERE n > 1)`)
+	if err != nil {
+		return err
+	}
+
+	if renamed, _ := res.RowsAffected(); renamed > 0 {
+		B.LogOut("Renamed " + strconv.FormatInt(renamed, 10) + " sites with a duplicate title")
+	}
+
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS sites_title_key ON sites (title)")
+	return err
+}
+
+// migrateSiteSettings adds the per site crawl settings
+func migrateSiteSettings(db *sql.DB) error {
+	queries := []string{
+		"ALTER TABLE sites ADD COLUMN IF NOT EXISTS language VARCHAR(10) NOT NULL DEFAULT ''",
+		"ALTER TABLE sites ADD COLUMN IF NOT EXISTS interval_minutes INT NOT NULL DEFAULT 0",
+		"ALTER TABLE sites ADD COLUMN IF NOT EXISTS user_agent VARCHAR(500) NOT NULL DEFAULT ''",
+		"ALTER TABLE sites ADD COLUMN IF NOT EXISTS headers JSONB NOT NULL DEFAULT '{}'",
+		"ALTER TABLE sites ADD COLUMN IF NOT EXISTS max_items INT NOT NULL DEFAULT 0",
+		"ALTER TABLE sites ADD COLUMN IF NOT EXISTS include_patterns TEXT[] NOT NULL DEFAULT '{}'",
+		"ALTER TABLE sites ADD COLUMN IF NOT EXISTS exclude_patterns TEXT[] NOT NULL DEFAULT '{}'",
+		"ALTER TABLE sites ADD COLUMN IF NOT EXISTS date_layouts TEXT[] NOT NULL DEFAULT '{}'",
+		"ALTER TABLE sites ADD COLUMN IF NOT EXISTS scrape JSONB",
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// siteColumns are the values of the settings columns in the order used by insert and Update
+func siteColumns(site Conf.Site) []any {
+	headers, _ := json.Marshal(site.Headers)
+	if site.Headers == nil {
+		headers = []byte("{}")
+	}
+
+	var scrape any
+	if site.Scrape != nil {
+		selectors, _ := json.Marshal((*SiteScrape)(site.Scrape))
+		scrape = string(selectors)
+	}
+
+	return []any{
+		strings.TrimSpace(site.Title), site.Url, site.HtmlUrl, site.Type, site.Category,
+		site.Language, site.Interval, site.UserAgent, string(headers), site.MaxItems,
+		pq.Array(nonNil(site.Include)), pq.Array(nonNil(site.Exclude)), site.IsEnabled(), pq.Array(nonNil(site.DateLayouts)),
+		scrape,
+	}
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
+
+func (s *SiteStore) load() error {
+	rows, err := s.db.Query(`SELECT id, title, url, html_url, type, category, language, interval_minutes, user_agent, headers,
+		max_items, include_patterns, exclude_patterns, enabled, date_layouts, scrape, created, updated FROM sites ORDER BY id`)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	all := []ManagedSite{}
+	for rows.Next() {
+		var m ManagedSite
+		var headers, scrape []byte
+		err := rows.Scan(&m.Id, &m.Title, &m.Url, &m.HtmlUrl, &m.Type, &m.Category, &m.Language, &m.Interval, &m.UserAgent, &headers,
+			&m.MaxItems, pq.Array(&m.Include), pq.Array(&m.Exclude), &m.Enabled, pq.Array(&m.DateLayouts), &scrape, &m.Created, &m.Updated)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(headers, &m.Headers); err != nil {
+			return err
+		}
+
+		if len(scrape) > 0 {
+			if err := json.Unmarshal(scrape, &m.Scrape); err != nil {
+				return err
+			}
+		}
+
+		all = append(all, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.all = all
+	s.mu.Unlock()
+
+	return nil
+}
+
+// reload refreshes the copy after a write and wakes the scheduler
+func (s *SiteStore) reload() {
+	if err := s.load(); err != nil {
+		B.LogErr(err)
+	}
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Sites returns the enabled sites, the copy is safe to keep
+func (s *SiteStore) Sites() Conf.SitesConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sites := Conf.SitesConfig{Title: s.title, Sites: []Conf.Site{}}
+	for _, m := range s.all {
+		if m.Enabled {
+			sites.Sites = append(sites.Sites, m.site())
+		}
+	}
+
+	return sites
+}
+
+// All returns every site including the disabled ones
+func (s *SiteStore) All() []ManagedSite {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]ManagedSite{}, s.all...)
+}
+
+func (s *SiteStore) find(id int) (ManagedSite, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, m := range s.all {
+		if m.Id == id {
+			return m, true
+		}
+	}
+
+	return ManagedSite{}, false
+}
+
+// Changed receives after the site list has been modified
+func (s *SiteStore) Changed() <-chan struct{} {
+	return s.changed
+}
+
+func validateSite(site Conf.Site) error {
+	if err := site.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidSite, strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+
+	if strings.ToLower(site.Type) == sourceHtml {
+		if _, err := compileScrape(site.Scrape); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidSite, err)
+		}
+	}
+
+	// The api must not be a way to read files of the server
+	if strings.HasPrefix(strings.ToLower(site.Url), "file:") {
+		return fmt.Errorf("%w: file urls can only be set in config.json", errInvalidSite)
+	}
+
+	return nil
+}
+
+func (s *SiteStore) insert(site Conf.Site) (int, error) {
+	var id int
+	err := s.db.QueryRow(`INSERT INTO sites (title, url, html_url, type, category, language, interval_minutes, user_agent, headers,
+		max_items, include_patterns, exclude_patterns, enabled, date_layouts, scrape) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT DO NOTHING RETURNING id`, siteColumns(site)...).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		var urlExists bool
+		if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM sites WHERE url = $1)", site.Url).Scan(&urlExists); err != nil {
+			return 0, err
+		}
+		if urlExists {
+			return 0, errSiteExists
+		}
+		return 0, errTitleExists
+	}
+
+	return id, err
+}
+
+func (s *SiteStore) Create(site Conf.Site) (ManagedSite, error) {
+	if err := validateSite(site); err != nil {
+		return ManagedSite{}, err
+	}
+
+	id, err := s.insert(site)
+	if err != nil {
+		return ManagedSite{}, err
+	}
+
+	s.reload()
+
+	created, _ := s.find(id)
+	return created, nil
+}
+
+// Update renames and recategorizes the items of the site along with it, feed_items refer to sites by their unique title
+func (s *SiteStore) Update(id int, update SiteUpdate) (ManagedSite, error) {
+	current, ok := s.find(id)
+	if !ok {
+		return ManagedSite{}, errSiteNotFound
+	}
+
+	next := current.site()
+	if update.Title != nil {
+		next.Title = strings.TrimSpace(*update.Title)
+	}
+	if update.Url != nil {
+		next.Url = *update.Url
+	}
+	if update.HtmlUrl != nil {
+		next.HtmlUrl = *update.HtmlUrl
+	}
+	if update.Type != nil {
+		next.Type = *update.Type
+	}
+	if update.Category != nil {
+		next.Category = *update.Category
+	}
+	if update.Language != nil {
+		next.Language = *update.Language
+	}
+	if update.Interval != nil {
+		next.Interval = *update.Interval
+	}
+	if update.UserAgent != nil {
+		next.UserAgent = *update.UserAgent
+	}
+	if update.Headers != nil {
+		next.Headers = *update.Headers
+	}
+	if update.MaxItems != nil {
+		next.MaxItems = *update.MaxItems
+	}
+	if update.Include != nil {
+		next.Include = *update.Include
+	}
+	if update.Exclude != nil {
+		next.Exclude = *update.Exclude
+	}
+	if update.DateLayouts != nil {
+		next.DateLayouts = *update.DateLayouts
+	}
+	if update.Enabled != nil {
+		next.Enabled = update.Enabled
+	}
+	if update.Scrape != nil {
+		next.Scrape = (*Conf.Scrape)(update.Scrape)
+	}
+
+	if err := validateSite(next); err != nil {
+		return ManagedSite{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ManagedSite{}, err
+	}
+
+	defer tx.Rollback()
+
+	var urlExists, titleExists bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM sites WHERE url = $1 AND id <> $3), EXISTS (SELECT 1 FROM sites WHERE title = $2 AND id <> $3)`,
+		next.Url, next.Title, id).Scan(&urlExists, &titleExists)
+	if err != nil {
+		return ManagedSite{}, err
+	}
+	if urlExists {
+		return ManagedSite{}, errSiteExists
+	}
+	if titleExists {
+		return ManagedSite{}, errTitleExists
+	}
+
+	_, err = tx.Exec(`UPDATE sites SET title = $1, url = $2, html_url = $3, type = $4, category = $5, language = $6, interval_minutes = $7,
+		user_agent = $8, headers = $9, max_items = $10, include_patterns = $11, exclude_patterns = $12, enabled = $13, date_layouts = $14,
+		scrape = $15, updated = NOW() WHERE id = $16`, append(siteColumns(next), id)...)
+	if err != nil {
+		return ManagedSite{}, err
+	}
+
+	if next.Title != current.Title {
+		if _, err := tx.Exec("UPDATE feed_items SET source = $1 WHERE source = $2", next.Title, current.Title); err != nil {
+			return ManagedSite{}, err
+		}
+	}
+
+	if next.Category != current.Category {
+		if _, err := tx.Exec("UPDATE feed_items SET category = $1 WHERE source = $2", next.Category, next.Title); err != nil {
+			return ManagedSite{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ManagedSite{}, err
+	}
+
+	s.reload()
+
+	updated, _ := s.find(id)
+	return updated, nil
+}
+
+// Delete removes the site, with purge its items and cached validators go too
+func (s *SiteStore) Delete(id int, purge bool) (int64, error) {
+	current, ok := s.find(id)
+	if !ok {
+		return 0, errSiteNotFound
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM sites WHERE id = $1", id); err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	if purge {
+		res, err := tx.Exec("DELETE FROM feed_items WHERE source = $1", current.Title)
+		if err != nil {
+			return 0, err
+		}
+
+		purged, _ = res.RowsAffected()
+
+		if _, err := tx.Exec("DELETE FROM feed_cache WHERE url = $1", current.Url); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	s.reload()
+
+	return purged, nil
+}
+
+// Merge adds sites by url, a known site keeps its settings and only gets the fields it is missing
+func (s *SiteStore) Merge(sites []Conf.Site) (added int, updated int) {
+	byUrl := make(map[string]ManagedSite)
+	for _, m := range s.All() {
+		byUrl[m.Url] = m
+	}
+
+	for _, site := range sites {
+		existing, ok := byUrl[site.Url]
+		if !ok {
+			if err := validateSite(site); err != nil {
+				B.LogOut("Skipping site " + site.Url + ": " + err.Error())
+				continue
+			}
+
+			if _, err := s.insert(site); err != nil {
+				B.LogErr(err)
+				continue
+			}
+
+			byUrl[site.Url] = ManagedSite{Title: site.Title, Url: site.Url, HtmlUrl: site.HtmlUrl, Category: site.Category}
+			added++
+			continue
+		}
+
+		if (existing.HtmlUrl != "" || site.HtmlUrl == "") && (existing.Category != "" || site.Category == "") {
+			continue
+		}
+
+		_, err := s.db.Exec(`UPDATE sites SET html_url = CASE WHEN html_url = '' THEN $1 ELSE html_url END,
+			category = CASE WHEN category = '' THEN $2 ELSE category END, updated = NOW() WHERE id = $3`,
+			site.HtmlUrl, site.Category, existing.Id)
+		if err != nil {
+			B.LogErr(err)
+			continue
+		}
+
+		if existing.Category == "" && site.Category != "" {
+			if _, err := s.db.Exec("UPDATE feed_items SET category = $1 WHERE source = $2 AND category = ''", site.Category, existing.Title); err != nil {
+				B.LogErr(err)
+			}
+		}
+
+		updated++
+	}
+
+	if added+updated > 0 {
+		s.reload()
+	}
+
+	return added, updated
+}
+
+func siteId(req *http.Request) (int, bool) {
+	id, err := strconv.Atoi(req.URL.Query().Get("id"))
+	return id, err == nil && id > 0
+}
+
+func writeSiteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errSiteNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, errSiteExists), errors.Is(err, errTitleExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errInvalidSite):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		B.LogErr(err)
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+	}
+}
+
+// ManageSitesHandler lists, creates, updates and deletes sites, changes reach the scheduler right away
+func ManageSitesHandler(store *SiteStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isAdmin(req) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var response any
+		status := http.StatusOK
+
+		switch req.Method {
+		case http.MethodGet:
+			response = store.All()
+
+		case http.MethodPost:
+			var site Conf.Site
+			if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&site); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+
+			created, err := store.Create(site)
+			if err != nil {
+				writeSiteError(w, err)
+				return
+			}
+
+			response = created
+			status = http.StatusCreated
+
+		case http.MethodPut:
+			id, ok := siteId(req)
+			if !ok {
+				http.Error(w, "Missing id", http.StatusBadRequest)
+				return
+			}
+
+			var update SiteUpdate
+			if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&update); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+
+			updated, err := store.Update(id, update)
+			if err != nil {
+				writeSiteError(w, err)
+				return
+			}
+
+			response = updated
+
+		case http.MethodDelete:
+			id, ok := siteId(req)
+			if !ok {
+				http.Error(w, "Missing id", http.StatusBadRequest)
+				return
+			}
+
+			purged, err := store.Delete(id, req.URL.Query().Get("purge") == "true")
+			if err != nil {
+				writeSiteError(w, err)
+				return
+			}
+
+			response = map[string]int64{"id": int64(id), "purged": purged}
+
+		default:
+			return
+		}
+
+		responseJson, _ := json.Marshal(response)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(status)
+		w.Write(responseJson)
+	}
+}
@@ -0,0 +1,79 @@
+// api/sites_test.go
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	Conf "github.com/janevala/home_be/config"
+)
+
+func newTestSiteStore(t *testing.T) (*SiteStore, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock := newMockDb(t)
+	store := &SiteStore{
+		db:      db,
+		all:     []ManagedSite{{Id: 1, Title: "Example", Url: "https://example.com/feed.xml", Type: "rss", Enabled: true}},
+		changed: make(chan struct{}, 1),
+	}
+
+	return store, mock
+}
+
+func TestSiteStoreConflicts(t *testing.T) {
+	t.Run("create with a taken title", func(t *testing.T) {
+		store, mock := newTestSiteStore(t)
+
+		mock.ExpectQuery("INSERT INTO sites").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM sites WHERE url = \\$1\\)").
+			WithArgs("https://other.example.com/feed.xml").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+		_, err := store.Create(Conf.Site{Title: "Taken", Url: "https://other.example.com/feed.xml"})
+		if !errors.Is(err, errTitleExists) {
+			t.Errorf("error = %v, want %v", err, errTitleExists)
+		}
+	})
+
+	tests := []struct {
+		name        string
+		urlExists   bool
+		titleExists bool
+		wantErr     error
+	}{
+		{name: "rename to a taken title", titleExists: true, wantErr: errTitleExists},
+		{name: "move to a taken url", urlExists: true, wantErr: errSiteExists},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, mock := newTestSiteStore(t)
+
+			title := "Taken"
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT EXISTS").
+				WithArgs("https://example.com/feed.xml", title, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"url", "title"}).AddRow(tt.urlExists, tt.titleExists))
+			mock.ExpectRollback()
+
+			_, err := store.Update(1, SiteUpdate{Title: &title})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+
+			rec := httptest.NewRecorder()
+			writeSiteError(rec, err)
+			if rec.Code != http.StatusConflict {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusConflict)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+// api/source.go
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+)
+
+// Site types, an empty type is treated as rss
+const (
+	sourceRss        = "rss"
+	sourceJsonFeed   = "jsonfeed"
+	sourceGoogleNews = "gnews"
+	sourceHackerNews = "hackernews"
+	sourceHtml       = "html"
+)
+
+// Source fetches a site and normalizes what it publishes into items
+type Source interface {
+	Fetch(ctx context.Context, site Conf.Site) (sourceResult, error)
+}
+
+type sourceResult struct {
+	items       []*NewsItem
+	status      int
+	notModified bool
+	bytes       int64
+	bytesSaved  int64
+	// WebSub hub advertised by the feed and the topic url to subscribe to
+	hub   string
+	topic string
+	// How often the feed says it changes, from ttl and sy:updatePeriod
+	hint time.Duration
+	// Validators of a parsed response, saved by the crawl once the items are stored
+	validators *feedCache
+}
+
+func sourceFor(site Conf.Site, db *sql.DB) (Source, error) {
+	switch strings.ToLower(site.Type) {
+	case "", sourceRss, "atom":
+		return &rssSource{db: db}, nil
+	case sourceJsonFeed:
+		return &jsonFeedSource{db: db}, nil
+	case sourceGoogleNews:
+		return &googleNewsSource{db: db}, nil
+	case sourceHackerNews:
+		return &hackerNewsSource{}, nil
+	case sourceHtml:
+		return &htmlSource{db: db}, nil
+	}
+
+	return nil, fmt.Errorf("unknown site type %q for %s", site.Type, site.Title)
+}
+
+// rssSource covers RSS, Atom and anything else gofeed detects
+type rssSource struct {
+	db *sql.DB
+}
+
+func (s *rssSource) Fetch(ctx context.Context, site Conf.Site) (sourceResult, error) {
+	fetched, err := fetchConditional(ctx, s.db, site)
+	if err != nil || fetched.notModified {
+		return fetched.result(), err
+	}
+
+	feed, err := parseFeedBody(site, fetched.body)
+	if err != nil {
+		return fetched.result(), err
+	}
+
+	result := fetched.result()
+	result.validators = fetched.validators()
+	result.items = feedToItems(site, feed)
+	result.hub, result.topic = discoverHub(site.Url, fetched.header, fetched.body)
+	result.hint = updateHint(fetched.body)
+	return result, nil
+}
+
+// parseFeedBody reads a fetched, pushed or archived body into gofeed's model the way the source of the site type does
+func parseFeedBody(site Conf.Site, body []byte) (*gofeed.Feed, error) {
+	switch strings.ToLower(site.Type) {
+	case sourceJsonFeed:
+		var parsed jsonFeed
+		if err := json.Unmarshal(body, &parsed); err != nil {
+			return nil, err
+		}
+		return parsed.universal(), nil
+
+	case sourceGoogleNews:
+		var sitemap googleNewsSitemap
+		if err := xml.Unmarshal(body, &sitemap); err != nil {
+			return nil, err
+		}
+		return sitemap.universal(), nil
+
+	case sourceHtml:
+		feed, _, err := scrapeHtml(site, body)
+		return feed, err
+	}
+
+	return newFeedParser().Parse(bytes.NewReader(body))
+}
+
+type conditionalFetch struct {
+	body        []byte
+	header      http.Header
+	status      int
+	notModified bool
+	bytesSaved  int64
+}
+
+func (f conditionalFetch) result() sourceResult {
+	return sourceResult{
+		status:      f.status,
+		notModified: f.notModified,
+		bytes:       int64(len(f.body)),
+		bytesSaved:  f.bytesSaved,
+	}
+}
+
+// validators of the response, taken once the body has been parsed so a broken body is fetched again
+func (f conditionalFetch) validators() *feedCache {
+	return &feedCache{
+		Etag:          f.header.Get("ETag"),
+		LastModified:  f.header.Get("Last-Modified"),
+		ContentLength: int64(len(f.body)),
+	}
+}
+
+// fetchConditional sends the validators of the previous response, a 304 answer has no body and counts the cached size as saved
+func fetchConditional(ctx context.Context, db *sql.DB, site Conf.Site) (conditionalFetch, error) {
+	var fetched conditionalFetch
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, site.Url, nil)
+	if err != nil {
+		return fetched, err
+	}
+
+	setSiteHeaders(req, site)
+
+	cache := loadFeedCache(db, site.Url)
+	if cache.Etag != "" {
+		req.Header.Set("If-None-Match", cache.Etag)
+	}
+	if cache.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cache.LastModified)
+	}
+
+	client := crawlClient
+	if req.URL.Scheme == "file" {
+		client = fileClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fetched, err
+	}
+
+	defer resp.Body.Close()
+
+	fetched.status = resp.StatusCode
+	fetched.header = resp.Header
+
+	if resp.StatusCode == http.StatusNotModified {
+		fetched.notModified = true
+		fetched.bytesSaved = cache.ContentLength
+		return fetched, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fetched, gofeed.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	fetched.body, err = readBody(resp.Body)
+	if err != nil {
+		return fetched, err
+	}
+
+	// Archived before parsing, a body that does not parse is what a parser fix needs most
+	archiveFeedBody(db, site, archiveFromFetch, resp.Request.URL.String(), resp.StatusCode, resp.Header, fetched.body)
+
+	return fetched, nil
+}
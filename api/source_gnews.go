@@ -0,0 +1,107 @@
+// api/source_gnews.go
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"strings"
+	"time"
+
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+)
+
+// googleNewsSitemap is a Google News sitemap (https://developers.google.com/search/docs/crawling-indexing/sitemaps/news-sitemap)
+type googleNewsSitemap struct {
+	XMLName xml.Name        `xml:"urlset"`
+	Urls    []googleNewsUrl `xml:"url"`
+}
+
+type googleNewsUrl struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+	News    struct {
+		Publication struct {
+			Name     string `xml:"name"`
+			Language string `xml:"language"`
+		} `xml:"http://www.google.com/schemas/sitemap-news/0.9 publication"`
+		PublicationDate string `xml:"http://www.google.com/schemas/sitemap-news/0.9 publication_date"`
+		Title           string `xml:"http://www.google.com/schemas/sitemap-news/0.9 title"`
+		Keywords        string `xml:"http://www.google.com/schemas/sitemap-news/0.9 keywords"`
+	} `xml:"http://www.google.com/schemas/sitemap-news/0.9 news"`
+	Images []struct {
+		Loc string `xml:"http://www.google.com/schemas/sitemap-image/1.1 loc"`
+	} `xml:"http://www.google.com/schemas/sitemap-image/1.1 image"`
+}
+
+// W3C datetime forms used by sitemaps
+var sitemapDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+}
+
+type googleNewsSource struct {
+	db *sql.DB
+}
+
+func (s *googleNewsSource) Fetch(ctx context.Context, site Conf.Site) (sourceResult, error) {
+	fetched, err := fetchConditional(ctx, s.db, site)
+	if err != nil || fetched.notModified {
+		return fetched.result(), err
+	}
+
+	feed, err := parseFeedBody(site, fetched.body)
+	if err != nil {
+		return fetched.result(), err
+	}
+
+	result := fetched.result()
+	result.validators = fetched.validators()
+	result.items = feedToItems(site, feed)
+	return result, nil
+}
+
+func (s googleNewsSitemap) universal() *gofeed.Feed {
+	feed := &gofeed.Feed{FeedType: "gnews"}
+
+	for _, entry := range s.Urls {
+		if entry.Loc == "" || entry.News.Title == "" {
+			continue
+		}
+
+		item := &gofeed.Item{
+			GUID:      entry.Loc,
+			Link:      entry.Loc,
+			Title:     entry.News.Title,
+			Published: entry.News.PublicationDate,
+		}
+
+		for _, layout := range sitemapDateLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(entry.News.PublicationDate)); err == nil {
+				item.PublishedParsed = &t
+				break
+			}
+		}
+
+		for _, keyword := range strings.Split(entry.News.Keywords, ",") {
+			if keyword = strings.TrimSpace(keyword); keyword != "" {
+				item.Categories = append(item.Categories, keyword)
+			}
+		}
+
+		if len(entry.Images) > 0 && entry.Images[0].Loc != "" {
+			item.Image = &gofeed.Image{URL: entry.Images[0].Loc}
+		}
+
+		if feed.Title == "" {
+			feed.Title = entry.News.Publication.Name
+			feed.Language = entry.News.Publication.Language
+		}
+
+		feed.Items = append(feed.Items, item)
+	}
+
+	return feed
+}
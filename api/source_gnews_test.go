@@ -0,0 +1,55 @@
+// api/source_gnews_test.go
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGoogleNewsSourceFetch(t *testing.T) {
+	testConditionalSource(t, sourceGoogleNews, "/news-sitemap.xml", "application/xml", []sourceTest{
+		{
+			name:   "items",
+			status: http.StatusOK,
+			body: `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9" xmlns:news="http://www.google.com/schemas/sitemap-news/0.9">
+  <url>
+    <loc>https://example.com/business/merger</loc>
+    <news:news>
+      <news:publication><news:name>Example Times</news:name><news:language>en</news:language></news:publication>
+      <news:publication_date>2026-03-01T10:00:00Z</news:publication_date>
+      <news:title>Companies agree on merger</news:title>
+    </news:news>
+  </url>
+  <url>
+    <loc>https://example.com/no-title</loc>
+  </url>
+  <url>
+    <loc>https://example.com/sports/final</loc>
+    <news:news>
+      <news:publication><news:name>Example Times</news:name><news:language>en</news:language></news:publication>
+      <news:publication_date>2026-03-02</news:publication_date>
+      <news:title>Home team wins the final</news:title>
+    </news:news>
+  </url>
+</urlset>`,
+			wantTitles: []string{"Companies agree on merger", "Home team wins the final"},
+		},
+		{
+			name:            "not modified",
+			cached:          &feedCache{Etag: testEtag, ContentLength: 4096},
+			wantNotModified: true,
+		},
+		{
+			name:    "malformed",
+			status:  http.StatusOK,
+			body:    `<urlset><url><loc>https://example.com/`,
+			wantErr: true,
+		},
+		{
+			name:   "empty",
+			status: http.StatusOK,
+			body:   `<?xml version="1.0" encoding="UTF-8"?><urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"></urlset>`,
+		},
+	})
+}
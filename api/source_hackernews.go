@@ -0,0 +1,145 @@
+// api/source_hackernews.go
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+)
+
+// Stories read from the list endpoint, the front page is 30
+const hackerNewsStories = 30
+
+type hackerNewsItem struct {
+	Id          int    `json:"id"`
+	Type        string `json:"type"`
+	By          string `json:"by"`
+	Time        int64  `json:"time"`
+	Title       string `json:"title"`
+	Url         string `json:"url"`
+	Text        string `json:"text"`
+	Score       int    `json:"score"`
+	Descendants int    `json:"descendants"`
+	Dead        bool   `json:"dead"`
+	Deleted     bool   `json:"deleted"`
+}
+
+// hackerNewsSource reads the Firebase style API, site url is a story list such as
+// https://hacker-news.firebaseio.com/v0/topstories.json and items are read from item/<id>.json next to it
+type hackerNewsSource struct{}
+
+func (s *hackerNewsSource) Fetch(ctx context.Context, site Conf.Site) (sourceResult, error) {
+	var result sourceResult
+
+	base, err := url.Parse(site.Url)
+	if err != nil {
+		return result, err
+	}
+
+	var ids []int
+	status, size, err := getJson(ctx, site, site.Url, &ids)
+	result.status = status
+	result.bytes += size
+	if err != nil {
+		return result, err
+	}
+
+	if len(ids) > hackerNewsStories {
+		ids = ids[:hackerNewsStories]
+	}
+
+	stories := make([]*hackerNewsItem, len(ids))
+	sizes := make([]int64, len(ids))
+
+	// All items live on one host, more requests in flight than it allows would only wait for a slot
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, politeness.hostParallel())
+	for i, id := range ids {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(i int, id int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			itemUrl := base.ResolveReference(&url.URL{Path: "item/" + strconv.Itoa(id) + ".json"}).String()
+
+			var story hackerNewsItem
+			_, size, err := getJson(ctx, site, itemUrl, &story)
+			sizes[i] = size
+			if err == nil {
+				stories[i] = &story
+			}
+		}(i, id)
+	}
+
+	wg.Wait()
+
+	feed := &gofeed.Feed{Title: "Hacker News", Link: "https://news.ycombinator.com/", FeedType: sourceHackerNews}
+	for i, story := range stories {
+		result.bytes += sizes[i]
+
+		if story == nil || story.Dead || story.Deleted || story.Title == "" {
+			continue
+		}
+
+		discussion := "https://news.ycombinator.com/item?id=" + strconv.Itoa(story.Id)
+		published := time.Unix(story.Time, 0).UTC()
+
+		item := &gofeed.Item{
+			GUID:            discussion,
+			Title:           story.Title,
+			Link:            story.Url,
+			Description:     story.Text,
+			Published:       published.Format(time.RFC1123Z),
+			PublishedParsed: &published,
+			Authors:         []*gofeed.Person{{Name: story.By}},
+		}
+
+		// Ask HN and other text posts have no url of their own
+		if item.Link == "" {
+			item.Link = discussion
+		}
+
+		feed.Items = append(feed.Items, item)
+	}
+
+	result.items = feedToItems(site, feed)
+	return result, nil
+}
+
+// getJson decodes a JSON response into v and reports the status and body size
+func getJson(ctx context.Context, site Conf.Site, u string, v any) (int, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	setSiteHeaders(req, site)
+
+	resp, err := crawlClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, 0, gofeed.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err := readBody(resp.Body)
+	if err != nil {
+		return resp.StatusCode, int64(len(body)), err
+	}
+
+	return resp.StatusCode, int64(len(body)), json.Unmarshal(body, v)
+}
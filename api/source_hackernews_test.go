@@ -0,0 +1,110 @@
+// api/source_hackernews_test.go
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	Conf "github.com/janevala/home_be/config"
+)
+
+func TestHackerNewsSourceFetch(t *testing.T) {
+	politeTesting(t)
+
+	stories := map[string]string{
+		"/v0/item/1.json": `{"id": 1, "type": "story", "by": "alice", "time": 1772359200, "title": "Show HN: A tiny database", "url": "https://example.com/db"}`,
+		"/v0/item/2.json": `{"id": 2, "type": "story", "by": "bob", "time": 1772362800, "title": "Ask HN: How do you test?", "text": "Curious"}`,
+		"/v0/item/3.json": `{"id": 3, "type": "story", "dead": true, "time": 1772366400, "title": "Dead story"}`,
+	}
+
+	tests := []struct {
+		name       string
+		status     int
+		list       string
+		wantErr    bool
+		wantStatus int
+		wantTitles []string
+		wantLinks  []string
+	}{
+		{
+			name:       "stories",
+			status:     http.StatusOK,
+			list:       `[1, 2, 3]`,
+			wantStatus: http.StatusOK,
+			// Newest first, text posts link to their discussion
+			wantTitles: []string{"Ask HN: How do you test?", "Show HN: A tiny database"},
+			wantLinks:  []string{"https://news.ycombinator.com/item?id=2", "https://example.com/db"},
+		},
+		{
+			// The API sends no validators, a 304 is unexpected and fails the fetch
+			name:       "not modified",
+			status:     http.StatusNotModified,
+			wantErr:    true,
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "malformed",
+			status:     http.StatusOK,
+			list:       `[1, 2,`,
+			wantErr:    true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "empty",
+			status:     http.StatusOK,
+			list:       `[]`,
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/v0/topstories.json" {
+					w.WriteHeader(tt.status)
+					w.Write([]byte(tt.list))
+					return
+				}
+
+				story, ok := stories[req.URL.Path]
+				if !ok {
+					http.NotFound(w, req)
+					return
+				}
+				w.Write([]byte(story))
+			}))
+			defer server.Close()
+
+			site := Conf.Site{Title: "Hacker News", Url: server.URL + "/v0/topstories.json", Type: sourceHackerNews}
+			source, err := sourceFor(site, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := source.Fetch(t.Context(), site)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if result.status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", result.status, tt.wantStatus)
+			}
+
+			normalizeItems(result.items)
+
+			var titles, links []string
+			for _, item := range result.items {
+				titles = append(titles, item.Title)
+				links = append(links, item.Link)
+			}
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("titles = %q, want %q", titles, tt.wantTitles)
+			}
+			if !reflect.DeepEqual(links, tt.wantLinks) {
+				t.Errorf("links = %q, want %q", links, tt.wantLinks)
+			}
+		})
+	}
+}
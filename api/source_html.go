@@ -0,0 +1,398 @@
+// api/source_html.go
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+var (
+	pageTitleSelector = cascadia.MustCompile("head title")
+	rootSelector      = cascadia.MustCompile("html")
+	linkSelector      = cascadia.MustCompile("a[href]")
+	imageSelector     = cascadia.MustCompile("img")
+)
+
+// htmlSource scrapes a page without a feed with the CSS selectors of the site
+type htmlSource struct {
+	db *sql.DB
+}
+
+func (s *htmlSource) Fetch(ctx context.Context, site Conf.Site) (sourceResult, error) {
+	fetched, err := fetchConditional(ctx, s.db, site)
+	if err != nil || fetched.notModified {
+		return fetched.result(), err
+	}
+
+	feed, err := parseFeedBody(site, fetched.body)
+	if err != nil {
+		return fetched.result(), err
+	}
+
+	result := fetched.result()
+	result.validators = fetched.validators()
+	result.items = feedToItems(site, feed)
+	return result, nil
+}
+
+// scrapeField is a compiled field selector, an attribute without a selector is read from the item element itself
+type scrapeField struct {
+	selector cascadia.Selector
+	attr     string
+}
+
+type scraper struct {
+	items       cascadia.Selector
+	title       scrapeField
+	link        scrapeField
+	date        scrapeField
+	image       scrapeField
+	description scrapeField
+}
+
+func compileScrape(s *Conf.Scrape) (*scraper, error) {
+	if s == nil {
+		return nil, errors.New("no scrape selectors")
+	}
+
+	items, err := cascadia.Compile(s.Items)
+	if err != nil {
+		return nil, fmt.Errorf("items selector %q: %w", s.Items, err)
+	}
+
+	compiled := &scraper{items: items}
+	for _, field := range []struct {
+		name     string
+		selector string
+		into     *scrapeField
+	}{
+		{"title", s.Title, &compiled.title},
+		{"link", s.Link, &compiled.link},
+		{"date", s.Date, &compiled.date},
+		{"image", s.Image, &compiled.image},
+		{"description", s.Description, &compiled.description},
+	} {
+		if *field.into, err = compileScrapeField(field.selector); err != nil {
+			return nil, fmt.Errorf("%s selector %q: %w", field.name, field.selector, err)
+		}
+	}
+
+	return compiled, nil
+}
+
+// compileScrapeField splits off a trailing @attribute, '@' has no meaning in CSS
+func compileScrapeField(value string) (scrapeField, error) {
+	var field scrapeField
+
+	value = strings.TrimSpace(value)
+	if at := strings.LastIndexByte(value, '@'); at >= 0 && !strings.ContainsAny(value[at:], " []()>+~,\"'") {
+		field.attr = strings.ToLower(value[at+1:])
+		value = strings.TrimSpace(value[:at])
+	}
+
+	if value == "" {
+		return field, nil
+	}
+
+	selector, err := cascadia.Compile(value)
+	if err != nil {
+		return field, err
+	}
+
+	field.selector = selector
+	return field, nil
+}
+
+func (f scrapeField) empty() bool {
+	return f.selector == nil && f.attr == ""
+}
+
+// node is the first match below the item, or the item itself, nil for a field the site does not scrape
+func (f scrapeField) node(item *html.Node) *html.Node {
+	if f.empty() {
+		return nil
+	}
+	if f.selector == nil {
+		return item
+	}
+
+	return f.selector.MatchFirst(item)
+}
+
+func (f scrapeField) text(item *html.Node) string {
+	n := f.node(item)
+	if n == nil {
+		return ""
+	}
+
+	if f.attr != "" {
+		return strings.TrimSpace(attr(n, f.attr))
+	}
+
+	return strings.TrimSpace(collapseSpaces(innerText(n)))
+}
+
+// scrapeHtml reads the items the selectors of the site find in a page into gofeed's model, so dates, thumbnails and
+// site rules work as they do for feeds. Matches without a title or a link are dropped, the count of matches is returned
+// alongside to tell a broken selector from an empty page.
+func scrapeHtml(site Conf.Site, body []byte) (*gofeed.Feed, int, error) {
+	s, err := compileScrape(site.Scrape)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	base, err := url.Parse(site.Url)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader, err := charset.NewReader(bytes.NewReader(body), "")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	doc, err := html.Parse(reader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	feed := &gofeed.Feed{FeedType: sourceHtml, Link: site.Url, Items: []*gofeed.Item{}}
+	if title := pageTitleSelector.MatchFirst(doc); title != nil {
+		feed.Title = strings.TrimSpace(collapseSpaces(innerText(title)))
+	}
+	if root := rootSelector.MatchFirst(doc); root != nil {
+		feed.Language = attr(root, "lang")
+	}
+
+	matches := s.items.MatchAll(doc)
+	if len(matches) == 0 {
+		return nil, 0, fmt.Errorf("items selector %q matched nothing", site.Scrape.Items)
+	}
+
+	for _, match := range matches {
+		title := s.title.text(match)
+		link := absoluteUrl(base, s.scrapeLink(match))
+		if title == "" || link == "" {
+			continue
+		}
+
+		item := &gofeed.Item{
+			// Feed text is html, escaped so plainText does not take a literal <tag> in a title for markup
+			Title:     html.EscapeString(title),
+			Link:      link,
+			Published: s.scrapeDate(match),
+		}
+
+		if description := s.description.node(match); description != nil {
+			if s.description.attr != "" {
+				item.Description = html.EscapeString(attr(description, s.description.attr))
+			} else {
+				item.Description = innerHtml(description)
+			}
+		}
+
+		if image := absoluteUrl(base, s.scrapeImage(match)); image != "" {
+			item.Image = &gofeed.Image{URL: image}
+		}
+
+		feed.Items = append(feed.Items, item)
+	}
+
+	return feed, len(matches), nil
+}
+
+func (s *scraper) scrapeLink(item *html.Node) string {
+	if s.link.attr != "" {
+		return s.link.text(item)
+	}
+
+	n := s.link.node(item)
+	if n == nil {
+		if title := s.title.node(item); title != nil && title.DataAtom == atom.A {
+			return attr(title, "href")
+		}
+		n = item
+	}
+
+	if n.DataAtom != atom.A {
+		if n = linkSelector.MatchFirst(n); n == nil {
+			return ""
+		}
+	}
+
+	return attr(n, "href")
+}
+
+// scrapeDate prefers the machine readable datetime of a <time> over its text
+func (s *scraper) scrapeDate(item *html.Node) string {
+	if s.date.attr != "" {
+		return s.date.text(item)
+	}
+
+	n := s.date.node(item)
+	if n == nil {
+		return ""
+	}
+
+	if datetime := attr(n, "datetime"); datetime != "" {
+		return strings.TrimSpace(datetime)
+	}
+
+	return strings.TrimSpace(collapseSpaces(innerText(n)))
+}
+
+// scrapeImage reads src, or data-src and the first srcset candidate of lazy loaded images
+func (s *scraper) scrapeImage(item *html.Node) string {
+	if s.image.attr != "" {
+		return s.image.text(item)
+	}
+
+	n := s.image.node(item)
+	if n == nil {
+		return ""
+	}
+
+	if n.DataAtom != atom.Img {
+		if n = imageSelector.MatchFirst(n); n == nil {
+			return ""
+		}
+	}
+
+	for _, name := range []string{"src", "data-src", "data-lazy-src"} {
+		if src := strings.TrimSpace(attr(n, name)); src != "" && !strings.HasPrefix(src, "data:") {
+			return src
+		}
+	}
+
+	if srcset := strings.Fields(attr(n, "srcset")); len(srcset) > 0 {
+		return srcset[0]
+	}
+
+	return ""
+}
+
+func innerHtml(n *html.Node) string {
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		html.Render(&sb, c)
+	}
+
+	return sb.String()
+}
+
+// ScrapePreview is what the selectors of a site make of a page, items as the crawler would store them
+type ScrapePreview struct {
+	Url     string      `json:"url"`
+	Matched int         `json:"matched"`
+	Skipped int         `json:"skipped"`
+	Items   []*NewsItem `json:"items"`
+}
+
+type scrapePreviewRequest struct {
+	Site Conf.Site `json:"site"`
+	// A saved page, the site url is fetched when empty
+	Html string `json:"html"`
+}
+
+// fetchPreviewPage reads the page like the crawler does, with the site headers and without decoding the charset
+func fetchPreviewPage(ctx context.Context, site Conf.Site) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoverTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, site.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	setSiteHeaders(req, site)
+
+	resp, err := crawlClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("fetch %s: %s", site.Url, resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxPageBytes))
+}
+
+// ScrapePreviewHandler runs the selectors of a site over its live page or a saved one, nothing is stored:
+// POST /sites/preview {"site": {"title": "...", "url": "...", "type": "html", "scrape": {...}}, "html": "..."}
+func ScrapePreviewHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost:
+			if !isAdmin(req) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			var preview scrapePreviewRequest
+			if err := json.NewDecoder(io.LimitReader(req.Body, maxPageBytes+(1<<20))).Decode(&preview); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+
+			site := preview.Site
+			site.Type = sourceHtml
+			if strings.TrimSpace(site.Title) == "" {
+				site.Title = "Preview"
+			}
+
+			if err := validateSite(site); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			page := []byte(preview.Html)
+			if len(page) == 0 {
+				var err error
+				if page, err = fetchPreviewPage(req.Context(), site); err != nil {
+					B.LogErr(err)
+					http.Error(w, "Fetch error: "+err.Error(), http.StatusBadGateway)
+					return
+				}
+			}
+
+			feed, matched, err := scrapeHtml(site, page)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+
+			items := applySiteRules(site, feedToItems(site, feed))
+			normalizeItems(items)
+
+			responseJson, _ := json.Marshal(ScrapePreview{
+				Url:     site.Url,
+				Matched: matched,
+				Skipped: matched - len(feed.Items),
+				Items:   items,
+			})
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			w.Write(responseJson)
+		}
+	}
+}
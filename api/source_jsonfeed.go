@@ -0,0 +1,194 @@
+// api/source_jsonfeed.go
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	Conf "github.com/janevala/home_be/config"
+	"github.com/mmcdole/gofeed"
+)
+
+// jsonFeed is the part of JSON Feed 1.0 and 1.1 (https://jsonfeed.org/version/1.1) the crawler uses
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageUrl string         `json:"home_page_url"`
+	Icon        string         `json:"icon"`
+	Language    string         `json:"language"`
+	FeedUrl     string         `json:"feed_url"`
+	NextUrl     string         `json:"next_url"`
+	Hubs        []jsonFeedHub  `json:"hubs"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedHub struct {
+	Type string `json:"type"`
+	Url  string `json:"url"`
+}
+
+type jsonFeedItem struct {
+	Id            json.RawMessage      `json:"id"`
+	Url           string               `json:"url"`
+	ExternalUrl   string               `json:"external_url"`
+	Title         string               `json:"title"`
+	ContentHtml   string               `json:"content_html"`
+	ContentText   string               `json:"content_text"`
+	Summary       string               `json:"summary"`
+	Image         string               `json:"image"`
+	BannerImage   string               `json:"banner_image"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Author        *jsonFeedAuthor      `json:"author"`
+	Authors       []jsonFeedAuthor     `json:"authors"`
+	Tags          []string             `json:"tags"`
+	Attachments   []jsonFeedAttachment `json:"attachments"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedAttachment struct {
+	Url         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	SizeInBytes int64  `json:"size_in_bytes"`
+}
+
+type jsonFeedSource struct {
+	db *sql.DB
+}
+
+func (s *jsonFeedSource) Fetch(ctx context.Context, site Conf.Site) (sourceResult, error) {
+	fetched, err := fetchConditional(ctx, s.db, site)
+	if err != nil || fetched.notModified {
+		return fetched.result(), err
+	}
+
+	var parsed jsonFeed
+	if err := json.Unmarshal(fetched.body, &parsed); err != nil {
+		return fetched.result(), err
+	}
+
+	result := fetched.result()
+	result.validators = fetched.validators()
+	result.items = feedToItems(site, parsed.universal())
+	result.hub, result.topic = discoverHub(site.Url, fetched.header, nil)
+	if result.hub == "" {
+		result.hub, result.topic = parsed.webSubHub(site.Url)
+	}
+	return result, nil
+}
+
+// webSubHub returns the first WebSub hub of the feed, the topic is feed_url when the feed has one
+func (f jsonFeed) webSubHub(feedUrl string) (string, string) {
+	base, err := url.Parse(feedUrl)
+	if err != nil {
+		return "", ""
+	}
+
+	for _, hub := range f.Hubs {
+		if !strings.EqualFold(hub.Type, "WebSub") {
+			continue
+		}
+
+		if hubUrl := absoluteUrl(base, hub.Url); hubUrl != "" {
+			topic := feedUrl
+			if self := absoluteUrl(base, f.FeedUrl); self != "" {
+				topic = self
+			}
+			return hubUrl, topic
+		}
+	}
+
+	return "", ""
+}
+
+// universal converts the feed into gofeed's model so it goes through the same normalization as RSS
+func (f jsonFeed) universal() *gofeed.Feed {
+	feed := &gofeed.Feed{
+		Title:       f.Title,
+		Link:        f.HomePageUrl,
+		Language:    f.Language,
+		FeedType:    "json",
+		FeedVersion: f.Version,
+	}
+
+	if f.Icon != "" {
+		feed.Image = &gofeed.Image{URL: f.Icon}
+	}
+
+	for _, entry := range f.Items {
+		item := &gofeed.Item{
+			GUID:        jsonFeedId(entry.Id),
+			Title:       entry.Title,
+			Link:        entry.Url,
+			Description: entry.Summary,
+			Content:     entry.ContentHtml,
+			Categories:  entry.Tags,
+			Published:   entry.DatePublished,
+			Updated:     entry.DateModified,
+		}
+
+		if item.Link == "" {
+			item.Link = entry.ExternalUrl
+		}
+		if item.Description == "" {
+			item.Description = entry.ContentHtml
+		}
+		if item.Description == "" {
+			item.Description = entry.ContentText
+		}
+		if item.Content == "" {
+			item.Content = entry.ContentText
+		}
+
+		if t, err := time.Parse(time.RFC3339, entry.DatePublished); err == nil {
+			item.PublishedParsed = &t
+		}
+		if t, err := time.Parse(time.RFC3339, entry.DateModified); err == nil {
+			item.UpdatedParsed = &t
+		}
+
+		if entry.Image != "" {
+			item.Image = &gofeed.Image{URL: entry.Image}
+		} else if entry.BannerImage != "" {
+			item.Image = &gofeed.Image{URL: entry.BannerImage}
+		}
+
+		authors := entry.Authors
+		if len(authors) == 0 && entry.Author != nil {
+			authors = []jsonFeedAuthor{*entry.Author}
+		}
+		for _, author := range authors {
+			item.Authors = append(item.Authors, &gofeed.Person{Name: author.Name})
+		}
+
+		for _, attachment := range entry.Attachments {
+			item.Enclosures = append(item.Enclosures, &gofeed.Enclosure{
+				URL:    attachment.Url,
+				Type:   attachment.MimeType,
+				Length: strconv.FormatInt(attachment.SizeInBytes, 10),
+			})
+		}
+
+		feed.Items = append(feed.Items, item)
+	}
+
+	return feed
+}
+
+// jsonFeedId accepts ids as strings and, against the spec but seen in the wild, as numbers
+func jsonFeedId(raw json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id
+	}
+
+	return strings.Trim(string(raw), `" `)
+}
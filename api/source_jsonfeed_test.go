@@ -0,0 +1,47 @@
+// api/source_jsonfeed_test.go
+package api
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestJsonFeedSourceFetch(t *testing.T) {
+	testConditionalSource(t, sourceJsonFeed, "/feed.json", "application/feed+json", []sourceTest{
+		{
+			name:   "items",
+			status: http.StatusOK,
+			body: `{
+				"version": "https://jsonfeed.org/version/1.1",
+				"title": "Example",
+				"items": [
+					{"id": "1", "url": "https://example.com/first", "title": "First post", "content_text": "Hello", "date_published": "2026-03-01T10:00:00Z"},
+					{"id": "2", "url": "https://example.com/second", "title": "Second post", "content_html": "<p>World</p>", "date_published": "2026-03-02T10:00:00Z"}
+				]
+			}`,
+			wantTitles: []string{"First post", "Second post"},
+		},
+		{
+			name:            "not modified",
+			cached:          &feedCache{Etag: testEtag, ContentLength: 1234},
+			wantNotModified: true,
+		},
+		{
+			name:    "malformed",
+			status:  http.StatusOK,
+			body:    `{"version": "https://jsonfeed.org/version/1.1", "items": [`,
+			wantErr: true,
+		},
+		{
+			name:   "empty",
+			status: http.StatusOK,
+			body:   `{"version": "https://jsonfeed.org/version/1.1", "title": "Example", "items": []}`,
+		},
+		{
+			name:    "server error",
+			status:  http.StatusInternalServerError,
+			body:    "down",
+			wantErr: true,
+		},
+	})
+}
@@ -0,0 +1,197 @@
+// api/source_test.go
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	Conf "github.com/janevala/home_be/config"
+)
+
+// sourceTest is one response of a feed server to a source that fetches with validators
+type sourceTest struct {
+	name    string
+	cached  *feedCache
+	status  int
+	body    string
+	wantErr bool
+	// Titles of the items in feed order, nil for none
+	wantTitles      []string
+	wantNotModified bool
+}
+
+const testEtag = `"v1"`
+
+// politeTesting drops the delay between requests to a host, every test server is a new host anyway
+func politeTesting(t *testing.T) {
+	t.Helper()
+
+	configurePoliteness(Conf.CrawlerConfig{HostDelay: 1, HostParallel: 8})
+	t.Cleanup(func() { configurePoliteness(Conf.CrawlerConfig{}) })
+}
+
+func newMockDb(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db, mock
+}
+
+func expectFeedCache(mock sqlmock.Sqlmock, cache *feedCache) {
+	query := mock.ExpectQuery("SELECT etag, last_modified, content_length FROM feed_cache")
+	if cache == nil {
+		query.WillReturnError(sql.ErrNoRows)
+		return
+	}
+
+	query.WillReturnRows(sqlmock.NewRows([]string{"etag", "last_modified", "content_length"}).
+		AddRow(cache.Etag, cache.LastModified, cache.ContentLength))
+}
+
+// expectArchive lets a body through archiveFeedBody as one already stored
+func expectArchive(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT true FROM feed_bodies").WillReturnRows(sqlmock.NewRows([]string{"stored"}).AddRow(true))
+	mock.ExpectExec("INSERT INTO feed_archive").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+// feedServer answers path with the response of the test, or 304 when the request carries the cached ETag.
+// robots.txt is missing, which allows everything.
+func feedServer(t *testing.T, path string, contentType string, tt sourceTest) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			http.NotFound(w, req)
+			return
+		}
+
+		if req.Header.Get("If-None-Match") == testEtag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", testEtag)
+		w.WriteHeader(tt.status)
+		w.Write([]byte(tt.body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// testConditionalSource runs a table against a source built on fetchConditional
+func testConditionalSource(t *testing.T, siteType string, path string, contentType string, tests []sourceTest) {
+	politeTesting(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := feedServer(t, path, contentType, tt)
+			db, mock := newMockDb(t)
+
+			expectFeedCache(mock, tt.cached)
+			if !tt.wantNotModified && tt.status == http.StatusOK {
+				expectArchive(mock)
+			}
+
+			site := Conf.Site{Title: "Test", Url: server.URL + path, Type: siteType}
+			source, err := sourceFor(site, db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := source.Fetch(t.Context(), site)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if result.notModified != tt.wantNotModified {
+				t.Errorf("notModified = %v, want %v", result.notModified, tt.wantNotModified)
+			}
+
+			var titles []string
+			for _, item := range result.items {
+				titles = append(titles, item.Title)
+			}
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("titles = %q, want %q", titles, tt.wantTitles)
+			}
+
+			// Validators are only handed on for a body that parsed
+			switch {
+			case tt.wantErr || tt.wantNotModified:
+				if result.validators != nil {
+					t.Errorf("validators = %+v, want none", result.validators)
+				}
+			case result.validators == nil || result.validators.Etag != testEtag:
+				t.Errorf("validators = %+v, want ETag %s", result.validators, testEtag)
+			}
+
+			if tt.wantNotModified && result.bytesSaved != tt.cached.ContentLength {
+				t.Errorf("bytesSaved = %d, want %d", result.bytesSaved, tt.cached.ContentLength)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRssSourceFetch(t *testing.T) {
+	testConditionalSource(t, "", "/rss.xml", "application/rss+xml", []sourceTest{
+		{
+			name:   "rss",
+			status: http.StatusOK,
+			body: `<?xml version="1.0" encoding="UTF-8"?>
+				<rss version="2.0"><channel><title>Example</title><link>https://example.com/</link>
+				<item><title>First story</title><link>https://example.com/first</link><guid>first</guid><pubDate>Sun, 01 Mar 2026 10:00:00 GMT</pubDate></item>
+				<item><title>Second story</title><link>https://example.com/second</link><guid>second</guid><pubDate>Mon, 02 Mar 2026 10:00:00 GMT</pubDate></item>
+				</channel></rss>`,
+			wantTitles: []string{"First story", "Second story"},
+		},
+		{
+			name:   "atom",
+			status: http.StatusOK,
+			body: `<?xml version="1.0" encoding="UTF-8"?>
+				<feed xmlns="http://www.w3.org/2005/Atom"><title>Example</title><id>urn:example</id><updated>2026-03-02T10:00:00Z</updated>
+				<entry><title>Atom entry</title><id>urn:example:1</id><link href="https://example.com/atom"/><updated>2026-03-02T10:00:00Z</updated></entry>
+				</feed>`,
+			wantTitles: []string{"Atom entry"},
+		},
+		{
+			name:            "not modified",
+			cached:          &feedCache{Etag: testEtag, ContentLength: 2048},
+			wantNotModified: true,
+		},
+		{
+			name:    "malformed",
+			status:  http.StatusOK,
+			body:    `<rss version="2.0"><channel><item><title>Cut off`,
+			wantErr: true,
+		},
+		{
+			name:    "not a feed",
+			status:  http.StatusOK,
+			body:    `<html><body>Moved</body></html>`,
+			wantErr: true,
+		},
+		{
+			name:    "server error",
+			status:  http.StatusInternalServerError,
+			body:    "down",
+			wantErr: true,
+		},
+	})
+}
@@ -0,0 +1,247 @@
+// api/thumbnail.go
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"net/url"
+	"strings"
+
+	B "github.com/janevala/home_be/build"
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Where the thumbnail of an item came from, stored in feed_items.thumbnail_origin
+const (
+	thumbnailMedia     = "media"
+	thumbnailEnclosure = "enclosure"
+	thumbnailInline    = "inline"
+	thumbnailItem      = "item"
+	thumbnailPage      = "og:image"
+	thumbnailFeed      = "feed"
+	thumbnailNone      = "none"
+)
+
+// Longest url that fits feed_items.thumbnail
+const maxThumbnailLength = 500
+
+// resolveThumbnail picks the item image from the feed alone, the linked page is only consulted later
+// for items that end up with the channel image or nothing
+func resolveThumbnail(item *gofeed.Item, feed *gofeed.Feed) (string, string) {
+	base, _ := url.Parse(item.Link)
+
+	if image := mediaImage(item.Extensions); image != "" {
+		if image = thumbnailUrl(base, image); image != "" {
+			return image, thumbnailMedia
+		}
+	}
+
+	for _, enclosure := range item.Enclosures {
+		if enclosure != nil && isImage(enclosure.Type, enclosure.URL) {
+			if image := thumbnailUrl(base, enclosure.URL); image != "" {
+				return image, thumbnailEnclosure
+			}
+		}
+	}
+
+	for _, document := range []string{item.Description, item.Content} {
+		if image := thumbnailUrl(base, firstInlineImage(document)); image != "" {
+			return image, thumbnailInline
+		}
+	}
+
+	if item.Image != nil {
+		if image := thumbnailUrl(base, item.Image.URL); image != "" {
+			return image, thumbnailItem
+		}
+	}
+
+	if feed.Image != nil {
+		if image := thumbnailUrl(nil, feed.Image.URL); image != "" {
+			return image, thumbnailFeed
+		}
+	}
+
+	return "", thumbnailNone
+}
+
+// mediaImage looks at media:thumbnail and image media:content, also inside media:group
+func mediaImage(extensions ext.Extensions) string {
+	media, ok := extensions["media"]
+	if !ok {
+		return ""
+	}
+
+	var find func(map[string][]ext.Extension) string
+	find = func(elements map[string][]ext.Extension) string {
+		for _, thumbnail := range elements["thumbnail"] {
+			if u := thumbnail.Attrs["url"]; u != "" {
+				return u
+			}
+		}
+
+		for _, content := range elements["content"] {
+			u := content.Attrs["url"]
+			if u == "" {
+				continue
+			}
+			if content.Attrs["medium"] == "image" || isImage(content.Attrs["type"], u) {
+				return u
+			}
+			if image := find(content.Children); image != "" {
+				return image
+			}
+		}
+
+		for _, group := range elements["group"] {
+			if image := find(group.Children); image != "" {
+				return image
+			}
+		}
+
+		return ""
+	}
+
+	return find(media)
+}
+
+func isImage(mimeType string, link string) bool {
+	if mimeType != "" {
+		return strings.HasPrefix(strings.ToLower(mimeType), "image/")
+	}
+
+	path := strings.ToLower(link)
+	if u, err := url.Parse(link); err == nil {
+		path = strings.ToLower(u.Path)
+	}
+
+	for _, suffix := range []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif"} {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// firstInlineImage returns the src of the first <img> that is not a tracking pixel
+func firstInlineImage(document string) string {
+	if !strings.Contains(document, "<img") {
+		return ""
+	}
+
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.DataAtom != atom.Img {
+				continue
+			}
+
+			var src, width, height string
+			for _, a := range token.Attr {
+				switch a.Key {
+				case "src":
+					src = a.Val
+				case "width":
+					width = a.Val
+				case "height":
+					height = a.Val
+				}
+			}
+
+			if src == "" || width == "1" || height == "1" {
+				continue
+			}
+
+			return src
+		}
+	}
+}
+
+// savePageThumbnail stores the og:image of the linked page of an item as its thumbnail
+func savePageThumbnail(db *sql.DB, id int, link string, page []byte) {
+	base, _ := url.Parse(link)
+	image := thumbnailUrl(base, pageImage(page))
+	if image == "" {
+		return
+	}
+
+	_, err := db.Exec("UPDATE feed_items SET thumbnail = $1, thumbnail_origin = $2 WHERE id = $3", image, thumbnailPage, id)
+	if err != nil {
+		B.LogErr(err)
+	}
+}
+
+// pageImage reads og:image, twitter:image or image_src from a page
+func pageImage(page []byte) string {
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		return ""
+	}
+
+	candidates := make(map[string]string)
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Meta:
+				key := attr(n, "property")
+				if key == "" {
+					key = attr(n, "name")
+				}
+				key = strings.ToLower(key)
+				if _, seen := candidates[key]; !seen {
+					candidates[key] = attr(n, "content")
+				}
+			case atom.Link:
+				if strings.EqualFold(attr(n, "rel"), "image_src") {
+					candidates["image_src"] = attr(n, "href")
+				}
+			case atom.Body:
+				return
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	for _, key := range []string{"og:image:secure_url", "og:image", "og:image:url", "twitter:image", "twitter:image:src", "image_src"} {
+		if image := candidates[key]; image != "" {
+			return image
+		}
+	}
+
+	return ""
+}
+
+func thumbnailUrl(base *url.URL, ref string) string {
+	if strings.HasPrefix(strings.TrimSpace(ref), "data:") {
+		return ""
+	}
+
+	image := absoluteUrl(base, ref)
+	if len(image) > maxThumbnailLength {
+		return ""
+	}
+
+	return image
+}
+
+func migrateThumbnails(db *sql.DB) error {
+	_, err := db.Exec("ALTER TABLE feed_items ADD COLUMN IF NOT EXISTS thumbnail_origin VARCHAR(20) NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
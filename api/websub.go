@@ -0,0 +1,700 @@
+// api/websub.go
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	B "github.com/janevala/home_be/build"
+	Conf "github.com/janevala/home_be/config"
+)
+
+const (
+	defaultWebSubLease = 10 * 24 * time.Hour
+	// Pushed sites are still polled this often in case a push gets lost
+	webSubPollInterval = 24 * time.Hour
+	// A request the hub has not verified, or a refused one, is sent again after this
+	webSubRetry         = time.Hour
+	webSubCheckInterval = 5 * time.Minute
+	webSubTimeout       = 30 * time.Second
+	webSubIngestTimeout = 5 * time.Minute
+	maxPushBytes        = 10 << 20
+)
+
+// Subscription states in websub_subscriptions
+const (
+	subscriptionPending       = "pending"
+	subscriptionActive        = "active"
+	subscriptionUnsubscribing = "unsubscribing"
+	subscriptionDenied        = "denied"
+	subscriptionFailed        = "failed"
+)
+
+// WebSub subscribes to the hubs feeds advertise (https://www.w3.org/TR/websub/) and stores what they push.
+// It is off unless the crawler has a public callback url.
+type WebSub struct {
+	db       *sql.DB
+	sites    *SiteStore
+	crawler  Conf.CrawlerConfig
+	callback string
+	lease    time.Duration
+	client   *http.Client
+
+	mu sync.RWMutex
+	// Site urls with a verified subscription
+	active map[string]bool
+
+	pushMu sync.Mutex
+	// Context of Run that stores pushed items, nil when not running
+	ingest context.Context
+	pushes sync.WaitGroup
+	done   chan struct{}
+}
+
+type subscription struct {
+	id      int
+	siteUrl string
+	hub     string
+	topic   string
+	state   string
+	lease   time.Duration
+	expires sql.NullTime
+	updated time.Time
+}
+
+func NewWebSub(sites *SiteStore, crawler Conf.CrawlerConfig, db *sql.DB) *WebSub {
+	w := &WebSub{
+		db:      db,
+		sites:   sites,
+		crawler: crawler,
+		lease:   defaultWebSubLease,
+		client:  &http.Client{Timeout: webSubTimeout},
+		active:  make(map[string]bool),
+		done:    make(chan struct{}),
+	}
+
+	if crawler.WebSubLease > 0 {
+		w.lease = time.Duration(crawler.WebSubLease) * time.Hour
+	}
+
+	if crawler.WebSubCallback == "" {
+		return w
+	}
+
+	if crawler.Replay != "" {
+		B.LogOut("WebSub is off while replaying fixtures")
+		return w
+	}
+
+	w.callback = crawler.WebSubCallback
+
+	w.loadActive()
+
+	return w
+}
+
+func createWebSubTableIfNeeded(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS websub_subscriptions (
+		id SERIAL UNIQUE,
+		site_url VARCHAR(500) PRIMARY KEY,
+		hub VARCHAR(500) NOT NULL,
+		topic VARCHAR(500) NOT NULL,
+		secret VARCHAR(100) NOT NULL,
+		state VARCHAR(20) NOT NULL,
+		lease_seconds INT NOT NULL DEFAULT 0,
+		expires timestamptz,
+		last_push timestamptz,
+		last_error TEXT NOT NULL DEFAULT '',
+		updated timestamptz NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (w *WebSub) Enabled() bool {
+	return w.callback != ""
+}
+
+// Active tells whether pushes arrive for the site, the scheduler then polls it only every webSubPollInterval
+func (w *WebSub) Active(siteUrl string) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.active[siteUrl]
+}
+
+func (w *WebSub) setActive(siteUrl string, active bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if active {
+		w.active[siteUrl] = true
+	} else {
+		delete(w.active, siteUrl)
+	}
+}
+
+func (w *WebSub) loadActive() {
+	rows, err := w.db.Query("SELECT site_url FROM websub_subscriptions WHERE state = $1 AND expires > NOW()", subscriptionActive)
+	if err != nil {
+		B.LogErr(err)
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var siteUrl string
+		if err := rows.Scan(&siteUrl); err != nil {
+			B.LogErr(err)
+			return
+		}
+
+		w.setActive(siteUrl, true)
+	}
+}
+
+// Discover subscribes to the hubs found while crawling, sites already subscribed are left alone until their lease runs low
+func (w *WebSub) Discover(ctx context.Context, results []CrawlResult) {
+	if !w.Enabled() {
+		return
+	}
+
+	for _, result := range results {
+		if result.Err != nil || result.Hub == "" {
+			continue
+		}
+
+		topic := result.Topic
+		if topic == "" {
+			topic = result.Url
+		}
+
+		sub, err := w.find("site_url", result.Url)
+		if err != nil && err != sql.ErrNoRows {
+			B.LogErr(err)
+			continue
+		}
+
+		if err == nil && sub.hub == result.Hub && sub.topic == topic && !w.due(sub, time.Now()) {
+			continue
+		}
+
+		if err := w.subscribe(ctx, result.Url, result.Hub, topic); err != nil {
+			B.LogErr(err)
+		}
+	}
+}
+
+// due tells whether a subscription should be requested again: renewal in the last fifth of the lease, otherwise
+// once webSubRetry has passed without an answer from the hub
+func (w *WebSub) due(sub subscription, now time.Time) bool {
+	if now.Sub(sub.updated) < webSubRetry {
+		return false
+	}
+
+	switch sub.state {
+	case subscriptionActive:
+		return !sub.expires.Valid || sub.expires.Time.Sub(now) < sub.lease/5
+	case subscriptionDenied, subscriptionFailed:
+		return now.Sub(sub.updated) >= webSubPollInterval
+	}
+
+	return true
+}
+
+func (w *WebSub) find(column string, value any) (subscription, error) {
+	var sub subscription
+	var leaseSeconds int
+	err := w.db.QueryRow(`SELECT id, site_url, hub, topic, state, lease_seconds, expires, updated
+		FROM websub_subscriptions WHERE `+column+` = $1`, value).Scan(
+		&sub.id, &sub.siteUrl, &sub.hub, &sub.topic, &sub.state, &leaseSeconds, &sub.expires, &sub.updated)
+	sub.lease = time.Duration(leaseSeconds) * time.Second
+
+	return sub, err
+}
+
+// subscribe asks the hub for pushes of topic, the hub confirms through a GET on the callback. Renewing keeps the secret
+// and the active state so pushes keep arriving meanwhile.
+func (w *WebSub) subscribe(ctx context.Context, siteUrl string, hub string, topic string) error {
+	var id int
+	var secret, state string
+	err := w.db.QueryRow(`INSERT INTO websub_subscriptions (site_url, hub, topic, secret, state, updated)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT (site_url) DO UPDATE SET
+			secret = CASE WHEN websub_subscriptions.hub = $2 AND websub_subscriptions.topic = $3 THEN websub_subscriptions.secret ELSE $4 END,
+			state = CASE WHEN websub_subscriptions.hub = $2 AND websub_subscriptions.topic = $3 AND websub_subscriptions.state = $6 THEN $6 ELSE $5 END,
+			hub = $2, topic = $3, last_error = '', updated = NOW()
+		RETURNING id, secret, state`, siteUrl, hub, topic, newSecret(), subscriptionPending, subscriptionActive).Scan(&id, &secret, &state)
+	if err != nil {
+		return err
+	}
+
+	if state != subscriptionActive {
+		w.setActive(siteUrl, false)
+	}
+
+	err = w.hubRequest(ctx, hub, url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.callback":      {w.callbackUrl(id)},
+		"hub.topic":         {topic},
+		"hub.lease_seconds": {strconv.Itoa(int(w.lease / time.Second))},
+		"hub.secret":        {secret},
+	})
+	if err != nil {
+		_, dbErr := w.db.Exec(`UPDATE websub_subscriptions SET state = CASE WHEN state = $2 THEN state ELSE $3 END, last_error = $4, updated = NOW()
+			WHERE id = $1`, id, subscriptionActive, subscriptionFailed, err.Error())
+		if dbErr != nil {
+			B.LogErr(dbErr)
+		}
+
+		return fmt.Errorf("websub subscribe %s: %w", topic, err)
+	}
+
+	B.LogOut("WebSub subscription requested: " + topic + " at " + hub)
+	return nil
+}
+
+// unsubscribe stops the pushes of a site that is gone, the row is removed once the hub confirms
+func (w *WebSub) unsubscribe(ctx context.Context, sub subscription) {
+	w.setActive(sub.siteUrl, false)
+
+	_, err := w.db.Exec("UPDATE websub_subscriptions SET state = $2, updated = NOW() WHERE id = $1", sub.id, subscriptionUnsubscribing)
+	if err != nil {
+		B.LogErr(err)
+		return
+	}
+
+	err = w.hubRequest(ctx, sub.hub, url.Values{
+		"hub.mode":     {"unsubscribe"},
+		"hub.callback": {w.callbackUrl(sub.id)},
+		"hub.topic":    {sub.topic},
+	})
+	if err != nil {
+		// Without the row further pushes are answered with 404, which ends the subscription as well
+		B.LogErr(fmt.Errorf("websub unsubscribe %s: %w", sub.topic, err))
+		w.delete(sub.id)
+		return
+	}
+
+	B.LogOut("WebSub unsubscription requested: " + sub.topic)
+}
+
+func (w *WebSub) delete(id int) {
+	if _, err := w.db.Exec("DELETE FROM websub_subscriptions WHERE id = $1", id); err != nil {
+		B.LogErr(err)
+	}
+}
+
+func (w *WebSub) callbackUrl(id int) string {
+	u, err := url.Parse(w.callback)
+	if err != nil {
+		return w.callback
+	}
+
+	query := u.Query()
+	query.Set("id", strconv.Itoa(id))
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+func (w *WebSub) hubRequest(ctx context.Context, hub string, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	politeness.mu.Lock()
+	req.Header.Set("User-Agent", politeness.userAgent)
+	politeness.mu.Unlock()
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("hub answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// Run renews leases, lets expired ones go and unsubscribes sites that were removed or disabled, until ctx is cancelled.
+// Pushes are stored in ctx too, Run returns once the ones in progress are done.
+func (w *WebSub) Run(ctx context.Context) {
+	defer close(w.done)
+
+	if !w.Enabled() {
+		return
+	}
+
+	B.LogOut("WebSub callback: " + w.callback)
+
+	w.pushMu.Lock()
+	w.ingest = ctx
+	w.pushMu.Unlock()
+	defer w.stopPushes()
+
+	ticker := time.NewTicker(webSubCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		w.maintain(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Done is closed when Run has returned
+func (w *WebSub) Done() <-chan struct{} {
+	return w.done
+}
+
+// startPush tracks storing a push, it fails when Run is not taking any
+func (w *WebSub) startPush() (context.Context, bool) {
+	w.pushMu.Lock()
+	defer w.pushMu.Unlock()
+
+	if w.ingest == nil {
+		return nil, false
+	}
+
+	w.pushes.Add(1)
+	return w.ingest, true
+}
+
+func (w *WebSub) stopPushes() {
+	w.pushMu.Lock()
+	w.ingest = nil
+	w.pushMu.Unlock()
+
+	w.pushes.Wait()
+}
+
+func (w *WebSub) maintain(ctx context.Context) {
+	rows, err := w.db.Query("SELECT id FROM websub_subscriptions ORDER BY id")
+	if err != nil {
+		B.LogErr(err)
+		return
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			B.LogErr(err)
+			break
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	live := make(map[string]bool)
+	for _, site := range w.sites.Sites().Sites {
+		live[site.Url] = true
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+
+		sub, err := w.find("id", id)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case !live[sub.siteUrl]:
+			if sub.state == subscriptionActive || sub.state == subscriptionPending {
+				w.unsubscribe(ctx, sub)
+			} else if sub.state != subscriptionUnsubscribing || now.Sub(sub.updated) >= webSubRetry {
+				w.delete(sub.id)
+			}
+
+		case sub.state == subscriptionActive && sub.expires.Valid && sub.expires.Time.Before(now):
+			w.setActive(sub.siteUrl, false)
+			_, err := w.db.Exec("UPDATE websub_subscriptions SET state = $2, last_error = 'lease expired', updated = NOW() WHERE id = $1",
+				sub.id, subscriptionFailed)
+			if err != nil {
+				B.LogErr(err)
+			}
+			B.LogOut("WebSub lease expired, polling again: " + sub.siteUrl)
+
+		case sub.state == subscriptionActive && w.due(sub, now):
+			if err := w.subscribe(ctx, sub.siteUrl, sub.hub, sub.topic); err != nil {
+				B.LogErr(err)
+			}
+		}
+	}
+}
+
+// verify answers the hub's confirmation of a subscribe or unsubscribe request we made, or takes note of a denial
+func (w *WebSub) verify(rw http.ResponseWriter, req *http.Request, id int) {
+	query := req.URL.Query()
+
+	sub, err := w.find("id", id)
+	if err == sql.ErrNoRows || (err == nil && query.Get("hub.topic") != sub.topic) {
+		http.Error(rw, "Unknown subscription", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		B.LogErr(err)
+		http.Error(rw, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	switch query.Get("hub.mode") {
+	case "subscribe":
+		if sub.state != subscriptionPending && sub.state != subscriptionActive {
+			http.Error(rw, "Unknown subscription", http.StatusNotFound)
+			return
+		}
+
+		lease := w.lease
+		if seconds, err := strconv.Atoi(query.Get("hub.lease_seconds")); err == nil && seconds > 0 {
+			lease = time.Duration(seconds) * time.Second
+		}
+
+		_, err := w.db.Exec(`UPDATE websub_subscriptions SET state = $2, lease_seconds = $3, expires = $4, last_error = '', updated = NOW()
+			WHERE id = $1`, id, subscriptionActive, int(lease/time.Second), time.Now().Add(lease))
+		if err != nil {
+			B.LogErr(err)
+			http.Error(rw, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		w.setActive(sub.siteUrl, true)
+		B.LogOut("WebSub subscription active for " + lease.String() + ": " + sub.topic)
+
+	case "unsubscribe":
+		if sub.state != subscriptionUnsubscribing {
+			http.Error(rw, "Unknown subscription", http.StatusNotFound)
+			return
+		}
+
+		w.delete(id)
+		B.LogOut("WebSub unsubscribed: " + sub.topic)
+
+	case "denied":
+		w.setActive(sub.siteUrl, false)
+		_, err := w.db.Exec("UPDATE websub_subscriptions SET state = $2, last_error = $3, updated = NOW() WHERE id = $1",
+			id, subscriptionDenied, "denied: "+query.Get("hub.reason"))
+		if err != nil {
+			B.LogErr(err)
+		}
+
+		B.LogOut("WebSub subscription denied: " + sub.topic)
+		rw.WriteHeader(http.StatusOK)
+		return
+
+	default:
+		http.Error(rw, "Invalid mode", http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(query.Get("hub.challenge")))
+}
+
+// receive takes a pushed feed document. Content with a bad signature is acknowledged but ignored as the spec asks,
+// items are stored in the background so the hub is not kept waiting.
+func (w *WebSub) receive(rw http.ResponseWriter, req *http.Request, id int) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPushBytes+1))
+	if err != nil {
+		http.Error(rw, "Read error", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxPushBytes {
+		http.Error(rw, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var siteUrl, topic, secret, state string
+	err = w.db.QueryRow("SELECT site_url, topic, secret, state FROM websub_subscriptions WHERE id = $1", id).Scan(&siteUrl, &topic, &secret, &state)
+	if err == sql.ErrNoRows || (err == nil && state != subscriptionActive) {
+		http.Error(rw, "Unknown subscription", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		B.LogErr(err)
+		http.Error(rw, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	if !validSignature(req.Header.Get("X-Hub-Signature"), secret, body) {
+		B.LogOut("WebSub push with a bad signature ignored: " + topic)
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	site, ok := w.site(siteUrl)
+	if !ok {
+		http.Error(rw, "Unknown subscription", http.StatusNotFound)
+		return
+	}
+
+	feed, err := parseFeedBody(site, body)
+	if err != nil {
+		B.LogOut("WebSub push of " + topic + " does not parse: " + err.Error())
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	archiveFeedBody(w.db, site, archiveFromPush, topic, http.StatusOK, req.Header, body)
+
+	items := applySiteRules(site, feedToItems(site, feed))
+
+	if _, err := w.db.Exec("UPDATE websub_subscriptions SET last_push = NOW() WHERE id = $1", id); err != nil {
+		B.LogErr(err)
+	}
+
+	runCtx, ok := w.startPush()
+	if !ok {
+		// The hub delivers again later
+		http.Error(rw, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+
+	go func() {
+		defer w.pushes.Done()
+
+		ctx, cancel := context.WithTimeout(runCtx, webSubIngestTimeout)
+		defer cancel()
+
+		inserted, revised := storeItems(ctx, w.db, w.crawler, items)
+		B.LogOut(fmt.Sprintf("WebSub push from %s: %d items, %d inserted, %d revised", site.Title, len(items), inserted[site.Url], revised[site.Url]))
+	}()
+}
+
+func (w *WebSub) site(siteUrl string) (Conf.Site, bool) {
+	for _, site := range w.sites.Sites().Sites {
+		if site.Url == siteUrl {
+			return site, true
+		}
+	}
+
+	return Conf.Site{}, false
+}
+
+// validSignature checks X-Hub-Signature, method=hexdigest over the body with the subscription secret
+func validSignature(header string, secret string, body []byte) bool {
+	method, signature, ok := strings.Cut(strings.TrimSpace(header), "=")
+	if !ok {
+		return false
+	}
+
+	var newHash func() hash.Hash
+	switch strings.ToLower(method) {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha384":
+		newHash = sha512.New384
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return false
+	}
+
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func newSecret() string {
+	secret := make([]byte, 24)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+// discoverHub finds the hub and self links of a feed, Link headers take precedence over links in the document.
+// The topic falls back to the feed url when there is no self link.
+func discoverHub(feedUrl string, header http.Header, body []byte) (string, string) {
+	base, err := url.Parse(feedUrl)
+	if err != nil {
+		return "", ""
+	}
+
+	links := headerLinks(base, header)
+	if links["hub"] == "" && len(body) > 0 {
+		links = documentLinks(base, body)
+	}
+
+	hub, self := links["hub"], links["self"]
+	if hub == "" {
+		return "", ""
+	}
+
+	if self == "" {
+		self = feedUrl
+	}
+
+	return hub, self
+}
+
+func WebSubHandler(webSub *WebSub) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !webSub.Enabled() {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		id, err := strconv.Atoi(req.URL.Query().Get("id"))
+		if err != nil || id <= 0 {
+			http.Error(w, "Unknown subscription", http.StatusNotFound)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			webSub.verify(w, req, id)
+		case http.MethodPost:
+			webSub.receive(w, req, id)
+		}
+	}
+}
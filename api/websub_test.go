@@ -0,0 +1,158 @@
+// api/websub_test.go
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	testTopic  = "https://example.com/feed.xml"
+	testSecret = "s3cret"
+)
+
+const testPush = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Example</title>
+<item><title>Pushed</title><link>https://example.com/pushed</link><guid>pushed-1</guid><pubDate>Sun, 01 Mar 2026 10:00:00 GMT</pubDate></item>
+</channel></rss>`
+
+// newTestWebSub is a WebSub with a callback and one enabled rss site, nothing running
+func newTestWebSub(t *testing.T) (*WebSub, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock := newMockDb(t)
+	sites := &SiteStore{db: db, all: []ManagedSite{{Id: 1, Title: "Example", Url: testTopic, Type: "rss", Enabled: true}}}
+
+	w := &WebSub{
+		db:       db,
+		sites:    sites,
+		callback: "https://home.example.com/websub",
+		lease:    defaultWebSubLease,
+		active:   make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+
+	return w, mock
+}
+
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebSubVerify(t *testing.T) {
+	w, mock := newTestWebSub(t)
+	server := httptest.NewServer(WebSubHandler(w))
+	defer server.Close()
+
+	mock.ExpectQuery("SELECT id, site_url, hub, topic, state, lease_seconds, expires, updated").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "site_url", "hub", "topic", "state", "lease_seconds", "expires", "updated"}).
+			AddRow(1, testTopic, "https://hub.example.com/", testTopic, subscriptionPending, 0, nil, time.Now()))
+	mock.ExpectExec("UPDATE websub_subscriptions SET state").
+		WithArgs(1, subscriptionActive, 3600, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	query := url.Values{
+		"id":                {"1"},
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {testTopic},
+		"hub.challenge":     {"challenge-123"},
+		"hub.lease_seconds": {"3600"},
+	}
+	resp, err := http.Get(server.URL + "/websub?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "challenge-123" {
+		t.Errorf("response = %d %q, want 200 with the challenge", resp.StatusCode, body)
+	}
+
+	if !w.Active(testTopic) {
+		t.Error("subscription is not active after the hub verified it")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebSubReceive(t *testing.T) {
+	tests := []struct {
+		name      string
+		signature string
+		wantStore bool
+	}{
+		{name: "missing signature"},
+		{name: "bad signature", signature: sign("other", testPush)},
+		{name: "malformed signature", signature: "sha256=zz"},
+		{name: "good signature", signature: sign(testSecret, testPush), wantStore: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, mock := newTestWebSub(t)
+			server := httptest.NewServer(WebSubHandler(w))
+			defer server.Close()
+
+			mock.ExpectQuery("SELECT site_url, topic, secret, state FROM websub_subscriptions").
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"site_url", "topic", "secret", "state"}).
+					AddRow(testTopic, testTopic, testSecret, subscriptionActive))
+
+			// Only a push that is stored gets a running WebSub, anything past the signature check
+			// would otherwise be answered 503
+			if tt.wantStore {
+				w.ingest = t.Context()
+
+				expectArchive(mock)
+				mock.ExpectExec("UPDATE websub_subscriptions SET last_push").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				// The item is known and unchanged, storing ends there
+				mock.ExpectQuery("SELECT id, title, description, link, uuid = \\$1 FROM feed_items").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "title", "description", "link", "identity"}).
+						AddRow(7, "Pushed", "", "https://example.com/pushed", true))
+			}
+
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/websub?id=1", strings.NewReader(testPush))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/rss+xml")
+			if tt.signature != "" {
+				req.Header.Set("X-Hub-Signature", tt.signature)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			// A hub is not told about a bad signature, it would just deliver again
+			if resp.StatusCode != http.StatusAccepted {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusAccepted)
+			}
+
+			w.stopPushes()
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
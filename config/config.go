@@ -2,9 +2,10 @@
 package config
 
 type Config struct {
-	Server ServerConfig
-	Ollama Ollama
-	Sites  SitesConfig
+	Server  ServerConfig
+	Ollama  Ollama
+	Crawler CrawlerConfig
+	Sites   SitesConfig
 }
 
 type ServerConfig struct {
@@ -19,12 +20,68 @@ type Ollama struct {
 	Model string
 }
 
+type CrawlerConfig struct {
+	Interval     int    // minutes, defaults to 120
+	Timeout      int    // seconds per site, defaults to 30
+	MaxParallel  int    // concurrent fetches, defaults to 4
+	Extract      bool   // extract the full text of new items while crawling
+	UserAgent    string // defaults to home_be/1.0 with a contact url
+	HostDelay    int    // milliseconds between requests to one host, defaults to 500
+	HostParallel int    // concurrent requests to one host, defaults to 2
+	Retries      int    // extra attempts after a transient error, defaults to 2
+
+	AdaptiveInterval bool // learn the interval of sites without their own from posting history and feed hints
+	MinInterval      int  // minutes, lower bound of learned intervals, defaults to 15
+	MaxInterval      int  // minutes, upper bound of learned intervals, defaults to 720
+
+	QuarantineAfter int // consecutive failed crawls before a site is quarantined, defaults to 5
+	QuarantineProbe int // minutes until the first probe of a quarantined site, doubles per failed probe, defaults to 360
+
+	Record string // directory every crawler response is saved to as a fixture
+	Replay string // directory of recorded fixtures served instead of the network
+
+	ArchiveDays   int // days raw feed bodies are kept for reparsing, 0 keeps them forever
+	BackfillPages int // feed pages a backfill follows when the request does not say, defaults to 10
+
+	WebSubCallback string // public url of the /websub endpoint, feeds with a hub are pushed instead of polled when set
+	WebSubLease    int    // hours of subscription asked from hubs, defaults to 240
+}
+
 type SitesConfig struct {
 	Title string
 	Sites []Site
 }
 
 type Site struct {
-	Title string
-	Url   string
+	Title       string            `json:"title"`
+	Url         string            `json:"url"` // http(s), or file:// for a local feed
+	HtmlUrl     string            `json:"htmlUrl"`
+	Type        string            `json:"type"` // rss (default, also Atom), jsonfeed, gnews, hackernews or html
+	Category    string            `json:"category"`
+	Language    string            `json:"language"`    // language of the items, taken from the feed when empty
+	Interval    int               `json:"interval"`    // minutes, defaults to the crawler interval or a learned one with adaptiveInterval
+	UserAgent   string            `json:"userAgent"`   // sent instead of the default User-Agent
+	Headers     map[string]string `json:"headers"`     // extra request headers
+	MaxItems    int               `json:"maxItems"`    // newest items kept per crawl, 0 keeps all
+	Include     []string          `json:"include"`     // title regexes, when set an item must match one
+	Exclude     []string          `json:"exclude"`     // title regexes, an item matching one is dropped
+	DateLayouts []string          `json:"dateLayouts"` // Go time layouts tried on dates gofeed cannot parse
+	Enabled     *bool             `json:"enabled"`     // defaults to true
+	Scrape      *Scrape           `json:"scrape"`      // selectors of an html site
+}
+
+// Scrape reads items out of a page with CSS selectors. The field selectors are relative to an item,
+// a trailing @name reads that attribute instead of the text, "h2 a@href" or just "@data-url" of the item itself.
+type Scrape struct {
+	Items       string `json:"items"` // one match per item, required
+	Title       string `json:"title"` // required
+	Link        string `json:"link"`  // defaults to the title when it is a link, then to the first link of the item
+	Date        string `json:"date"`  // datetime attribute or text, parsed with the date layouts of the site
+	Image       string `json:"image"` // src of the image, or of the first image inside the match
+	Description string `json:"description"`
+}
+
+// IsEnabled treats a missing enabled flag as true
+func (s Site) IsEnabled() bool {
+	return s.Enabled == nil || *s.Enabled
 }
@@ -0,0 +1,135 @@
+// config/validate.go
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Site types known to the crawler
+var siteTypes = map[string]bool{
+	"":           true,
+	"rss":        true,
+	"atom":       true,
+	"jsonfeed":   true,
+	"gnews":      true,
+	"hackernews": true,
+	"html":       true,
+}
+
+// Validate reports every problem of the config at once
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Crawler.Interval < 0 || c.Crawler.Timeout < 0 || c.Crawler.MaxParallel < 0 || c.Crawler.HostDelay < 0 || c.Crawler.HostParallel < 0 ||
+		c.Crawler.Retries < 0 || c.Crawler.QuarantineAfter < 0 || c.Crawler.QuarantineProbe < 0 || c.Crawler.WebSubLease < 0 || c.Crawler.ArchiveDays < 0 ||
+		c.Crawler.BackfillPages < 0 || c.Crawler.MinInterval < 0 || c.Crawler.MaxInterval < 0 {
+		errs = append(errs, errors.New("crawler: numeric settings must not be negative"))
+	}
+
+	if c.Crawler.MinInterval > 0 && c.Crawler.MaxInterval > 0 && c.Crawler.MinInterval > c.Crawler.MaxInterval {
+		errs = append(errs, errors.New("crawler: minInterval must not exceed maxInterval"))
+	}
+
+	if c.Crawler.Record != "" && c.Crawler.Replay != "" {
+		errs = append(errs, errors.New("crawler: record and replay cannot both be set"))
+	}
+
+	if c.Crawler.WebSubCallback != "" {
+		if u, err := url.Parse(c.Crawler.WebSubCallback); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("crawler: webSubCallback %q must be an absolute http or https url", c.Crawler.WebSubCallback))
+		}
+	}
+
+	urls := make(map[string]bool)
+	titles := make(map[string]bool)
+	for i, site := range c.Sites.Sites {
+		name := site.Title
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		if err := site.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("site %s: %s", name, strings.ReplaceAll(err.Error(), "\n", "; ")))
+		}
+
+		if urls[site.Url] {
+			errs = append(errs, fmt.Errorf("site %s: duplicate url %s", name, site.Url))
+		}
+		urls[site.Url] = true
+
+		// Items refer to their site by title
+		if titles[site.Title] {
+			errs = append(errs, fmt.Errorf("site %s: duplicate title", name))
+		}
+		titles[site.Title] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s Site) Validate() error {
+	var errs []error
+
+	if strings.TrimSpace(s.Title) == "" {
+		errs = append(errs, errors.New("title is required"))
+	}
+
+	if u, err := url.Parse(s.Url); err != nil || !validSiteUrl(u) {
+		errs = append(errs, fmt.Errorf("url %q must be an absolute http, https or file url", s.Url))
+	}
+
+	if !siteTypes[strings.ToLower(s.Type)] {
+		errs = append(errs, fmt.Errorf("unknown type %q", s.Type))
+	}
+
+	if s.Interval < 0 {
+		errs = append(errs, errors.New("interval must not be negative"))
+	}
+
+	if s.MaxItems < 0 {
+		errs = append(errs, errors.New("maxItems must not be negative"))
+	}
+
+	for name := range s.Headers {
+		if name == "" || strings.ContainsAny(name, " :\r\n") || http.CanonicalHeaderKey(name) == "Host" {
+			errs = append(errs, fmt.Errorf("invalid header %q", name))
+		}
+	}
+
+	for _, layout := range s.DateLayouts {
+		if strings.TrimSpace(layout) == "" {
+			errs = append(errs, errors.New("empty date layout"))
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, s.Include...), s.Exclude...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("invalid title pattern: %w", err))
+		}
+	}
+
+	if strings.ToLower(s.Type) == "html" {
+		if s.Scrape == nil || strings.TrimSpace(s.Scrape.Items) == "" || strings.TrimSpace(s.Scrape.Title) == "" {
+			errs = append(errs, errors.New("html sites need scrape selectors for items and title"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validSiteUrl accepts file urls so a site can be crawled from a local feed, file://feeds/a.xml is relative to the working directory
+func validSiteUrl(u *url.URL) bool {
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host != ""
+	case "file":
+		return u.Host != "" || u.Path != ""
+	}
+
+	return false
+}
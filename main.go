@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -28,6 +29,10 @@ var (
 	cfg         *Conf.Config
 	db          *sql.DB
 	httpStats   *HTTPStats
+	scheduler   *Api.Scheduler
+	siteStore   *Api.SiteStore
+	webSub      *Api.WebSub
+	backfills   *Api.Backfills
 )
 
 type statusWriter struct {
@@ -294,6 +299,29 @@ func prometheusMetrics() string {
 	metrics = append(metrics, "# TYPE pg_connections_in_use gauge")
 	metrics = append(metrics, fmt.Sprintf("pg_connections_in_use %d", dbStats.InUse))
 
+	// Crawler metrics
+	crawlStats := scheduler.Stats()
+	metrics = append(metrics, "")
+	metrics = append(metrics, "# HELP crawler_fetches_total Number of feed fetches")
+	metrics = append(metrics, "# TYPE crawler_fetches_total counter")
+	metrics = append(metrics, fmt.Sprintf("crawler_fetches_total %d", crawlStats.Fetches))
+	metrics = append(metrics, "")
+	metrics = append(metrics, "# HELP crawler_not_modified_total Number of feed fetches answered with 304 Not Modified")
+	metrics = append(metrics, "# TYPE crawler_not_modified_total counter")
+	metrics = append(metrics, fmt.Sprintf("crawler_not_modified_total %d", crawlStats.NotModified))
+	metrics = append(metrics, "")
+	metrics = append(metrics, "# HELP crawler_bytes_fetched_total Feed bytes downloaded")
+	metrics = append(metrics, "# TYPE crawler_bytes_fetched_total counter")
+	metrics = append(metrics, fmt.Sprintf("crawler_bytes_fetched_total %d", crawlStats.BytesFetched))
+	metrics = append(metrics, "")
+	metrics = append(metrics, "# HELP crawler_bytes_saved_total Feed bytes not downloaded thanks to conditional GET")
+	metrics = append(metrics, "# TYPE crawler_bytes_saved_total counter")
+	metrics = append(metrics, fmt.Sprintf("crawler_bytes_saved_total %d", crawlStats.BytesSaved))
+	metrics = append(metrics, "")
+	metrics = append(metrics, "# HELP crawler_disallowed_total Requests refused by robots.txt")
+	metrics = append(metrics, "# TYPE crawler_disallowed_total counter")
+	metrics = append(metrics, fmt.Sprintf("crawler_disallowed_total %d", crawlStats.Disallowed))
+
 	// Go runtime metrics
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -317,6 +345,10 @@ func main() {
 	logger := log.New(log.Writer(), "[HTTP] ", log.LstdFlags)
 	B.SetLogger(logger)
 
+	if len(os.Args) > 1 && os.Args[1] == "reparse" {
+		os.Exit(reparseCommand(os.Args[2:]))
+	}
+
 	B.LogOut("In main()...")
 
 	if cfg == nil {
@@ -336,12 +368,22 @@ func main() {
 	B.LogOut("Go Version: " + runtime.Version())
 	B.LogOut("Server listening on: " + cfg.Server.Port)
 	B.LogOut("Server: " + fmt.Sprintf("%#v", cfg.Server))
-	B.LogOut("Sites: " + fmt.Sprintf("%#v", cfg.Sites))
+	B.LogOut("Sites: " + fmt.Sprintf("%#v", siteStore.Sites()))
 	B.LogOut("Ollama: " + fmt.Sprintf("%#v", cfg.Ollama))
+	B.LogOut("Crawler: " + fmt.Sprintf("%#v", cfg.Crawler))
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	go scheduler.Run(ctx)
+	go webSub.Run(ctx)
+
+	extractionDone := make(chan struct{})
+	go func() {
+		defer close(extractionDone)
+		Api.RunExtraction(ctx, cfg.Crawler, db)
+	}()
+
 	go func() {
 		B.LogOut("Server started...")
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -360,9 +402,76 @@ func main() {
 		B.LogErr(err)
 	}
 
+	select {
+	case <-scheduler.Done():
+	case <-shutdownCtx.Done():
+		B.LogOut("Scheduler did not stop in time")
+	}
+
+	select {
+	case <-extractionDone:
+	case <-shutdownCtx.Done():
+		B.LogOut("Extraction did not stop in time")
+	}
+
+	select {
+	case <-webSub.Done():
+	case <-shutdownCtx.Done():
+		B.LogOut("WebSub pushes were not stored in time")
+	}
+
 	B.LogOut("Server exited properly")
 }
 
+// reparseCommand runs archived feed bodies through parsing again instead of starting the server:
+// home_be_backend reparse -from 2026-01-01 [-to 2026-02-01] [-site https://example.com/feed]
+func reparseCommand(args []string) int {
+	defer db.Close()
+
+	flags := flag.NewFlagSet("reparse", flag.ContinueOnError)
+	from := flags.String("from", "", "start of the fetch time range, 2006-01-02 or RFC 3339, required")
+	to := flags.String("to", "", "end of the fetch time range, exclusive, defaults to now")
+	site := flags.String("site", "", "url of the site to reparse, all sites when empty")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	start, err := parseCommandTime(*from)
+	if err != nil {
+		fmt.Println("reparse: -from: " + err.Error())
+		return 2
+	}
+
+	end := time.Now()
+	if *to != "" {
+		if end, err = parseCommandTime(*to); err != nil {
+			fmt.Println("reparse: -to: " + err.Error())
+			return 2
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	result, err := Api.Reparse(ctx, db, siteStore, cfg.Crawler, start, end, *site)
+	if err != nil {
+		B.LogErr(err)
+		return 1
+	}
+
+	resultJson, _ := json.MarshalIndent(result, "", "\t")
+	fmt.Println(string(resultJson))
+	return 0
+}
+
+func parseCommandTime(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.UTC); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
 func init() {
 	// TODO: logger is not set yet, check main
 	fmt.Println("In init()...")
@@ -395,9 +504,24 @@ func init() {
 	db.SetConnMaxLifetime(5 * time.Minute)
 	db.SetConnMaxIdleTime(5 * time.Minute)
 
+	fmt.Println("Migrating database...")
+	if err = Api.Migrate(db); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	fmt.Println("Server port: " + cfg.Server.Port)
 
 	httpStats = NewHTTPStats()
+	siteStore, err = Api.NewSiteStore(cfg.Sites, db)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	webSub = Api.NewWebSub(siteStore, cfg.Crawler, db)
+	scheduler = Api.NewScheduler(siteStore, webSub, cfg.Crawler, db)
+	backfills = Api.NewBackfills(cfg.Crawler, db)
 
 	httpRouter := http.NewServeMux()
 
@@ -439,12 +563,40 @@ func init() {
 	httpRouter.HandleFunc("OPTIONS /archive", Api.ArticlesHandler(db))
 	httpRouter.HandleFunc("GET /article", Api.ArticleHandler(db))
 	httpRouter.HandleFunc("OPTIONS /article", Api.ArticleHandler(db))
+	httpRouter.HandleFunc("GET /article/content", Api.ArticleContentHandler(db))
+	httpRouter.HandleFunc("OPTIONS /article/content", Api.ArticleContentHandler(db))
+	httpRouter.HandleFunc("GET /article/revisions", Api.ArticleRevisionsHandler(db))
+	httpRouter.HandleFunc("OPTIONS /article/revisions", Api.ArticleRevisionsHandler(db))
 	httpRouter.HandleFunc("OPTIONS /search", Api.SearchHandler(db))
 	httpRouter.HandleFunc("GET /search", Api.SearchHandler(db))
-	httpRouter.HandleFunc("OPTIONS /refresh", Api.ArchiveRefreshHandler(cfg.Sites, db))
-	httpRouter.HandleFunc("GET /refresh", Api.ArchiveRefreshHandler(cfg.Sites, db))
-	httpRouter.HandleFunc("GET /sites", Api.SitesHandler(cfg.Sites))
-	httpRouter.HandleFunc("OPTIONS /sites", Api.SitesHandler(cfg.Sites))
+	httpRouter.HandleFunc("OPTIONS /refresh", Api.ArchiveRefreshHandler(scheduler, db))
+	httpRouter.HandleFunc("GET /refresh", Api.ArchiveRefreshHandler(scheduler, db))
+	httpRouter.HandleFunc("GET /scheduler", Api.SchedulerHandler(scheduler))
+	httpRouter.HandleFunc("OPTIONS /scheduler", Api.SchedulerHandler(scheduler))
+	httpRouter.HandleFunc("GET /sites", Api.SitesHandler(siteStore))
+	httpRouter.HandleFunc("OPTIONS /sites", Api.SitesHandler(siteStore))
+	httpRouter.HandleFunc("GET /sites/manage", Api.ManageSitesHandler(siteStore))
+	httpRouter.HandleFunc("POST /sites/manage", Api.ManageSitesHandler(siteStore))
+	httpRouter.HandleFunc("PUT /sites/manage", Api.ManageSitesHandler(siteStore))
+	httpRouter.HandleFunc("DELETE /sites/manage", Api.ManageSitesHandler(siteStore))
+	httpRouter.HandleFunc("OPTIONS /sites/manage", Api.ManageSitesHandler(siteStore))
+	httpRouter.HandleFunc("GET /sites.opml", Api.SitesOpmlHandler(siteStore))
+	httpRouter.HandleFunc("POST /sites.opml", Api.SitesOpmlHandler(siteStore))
+	httpRouter.HandleFunc("OPTIONS /sites.opml", Api.SitesOpmlHandler(siteStore))
+	httpRouter.HandleFunc("GET /sites/quarantine", Api.QuarantineHandler(scheduler))
+	httpRouter.HandleFunc("POST /sites/quarantine", Api.QuarantineHandler(scheduler))
+	httpRouter.HandleFunc("OPTIONS /sites/quarantine", Api.QuarantineHandler(scheduler))
+	httpRouter.HandleFunc("GET /sites/health", Api.SiteHealthHandler(siteStore, db))
+	httpRouter.HandleFunc("OPTIONS /sites/health", Api.SiteHealthHandler(siteStore, db))
+	httpRouter.HandleFunc("GET /sites/backfill", Api.BackfillHandler(backfills, siteStore))
+	httpRouter.HandleFunc("POST /sites/backfill", Api.BackfillHandler(backfills, siteStore))
+	httpRouter.HandleFunc("OPTIONS /sites/backfill", Api.BackfillHandler(backfills, siteStore))
+	httpRouter.HandleFunc("POST /sites/preview", Api.ScrapePreviewHandler())
+	httpRouter.HandleFunc("OPTIONS /sites/preview", Api.ScrapePreviewHandler())
+	httpRouter.HandleFunc("GET /discover", Api.DiscoverHandler())
+	httpRouter.HandleFunc("OPTIONS /discover", Api.DiscoverHandler())
+	httpRouter.HandleFunc("GET /websub", Api.WebSubHandler(webSub))
+	httpRouter.HandleFunc("POST /websub", Api.WebSubHandler(webSub))
 
 	corsRouter := corsMiddleware(httpRouter)
 
@@ -454,15 +606,26 @@ func init() {
 	http.Handle("/articles", corsRouter)
 	http.Handle("/archive", corsRouter)
 	http.Handle("/article", corsRouter)
+	http.Handle("/article/content", corsRouter)
+	http.Handle("/article/revisions", corsRouter)
 	http.Handle("/search", corsRouter)
 	http.Handle("/refresh", corsRouter)
 	http.Handle("/sites", corsRouter)
+	http.Handle("/sites/manage", corsRouter)
+	http.Handle("/sites.opml", corsRouter)
+	http.Handle("/sites/health", corsRouter)
+	http.Handle("/sites/quarantine", corsRouter)
+	http.Handle("/sites/backfill", corsRouter)
+	http.Handle("/sites/preview", corsRouter)
+	http.Handle("/discover", corsRouter)
+	http.Handle("/websub", corsRouter)
+	http.Handle("/scheduler", corsRouter)
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		if B.IsProduction() {
 			w.Header().Set("Access-Control-Allow-Origin", "https://techeavy.news")